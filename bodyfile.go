@@ -0,0 +1,83 @@
+package recorder
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// bodyFilePrefix returns the prefix of body files for the recording, which
+// is its name without extensions.
+func bodyFilePrefix(filename string) string {
+	name := strings.TrimSuffix(path.Base(filename), ".gz")
+	return strings.TrimSuffix(name, path.Ext(name)) + "."
+}
+
+// splitBodyFiles returns a copy of entries with response bodies larger than
+// threshold replaced with references to body files. The returned map
+// contains the contents of each body file by name.
+func splitBodyFiles(filename string, entries []Entry, threshold int) ([]Entry, map[string]string) {
+	prefix := bodyFilePrefix(filename)
+	out := make([]Entry, len(entries))
+	bodies := make(map[string]string)
+	for i, e := range entries {
+		if e.Response != nil && len(e.Response.Body) > threshold {
+			resp := *e.Response
+			resp.BodyFile = prefix + strconv.Itoa(i) + ".body"
+			bodies[resp.BodyFile] = resp.Body
+			resp.Body = ""
+			e.Response = &resp
+		}
+		out[i] = e
+	}
+	return out, bodies
+}
+
+// loadBodyFiles reads the bodies of entries stored in body files.
+func loadBodyFiles(filename string, entries []Entry) error {
+	dir := path.Dir(filename)
+	for i := range entries {
+		resp := entries[i].Response
+		if resp == nil || resp.BodyFile == "" {
+			continue
+		}
+		b, err := ioutil.ReadFile(path.Join(dir, resp.BodyFile))
+		if err != nil {
+			return fmt.Errorf("read body of entry %d: %v", i, err)
+		}
+		resp.Body = string(b)
+		resp.BodyFile = ""
+	}
+	return nil
+}
+
+// removeBodyFiles removes body files belonging to the recording that are not
+// in keep.
+func removeBodyFiles(filename string, keep map[string]string) error {
+	dir := path.Dir(filename)
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	prefix := bodyFilePrefix(filename)
+	for _, f := range files {
+		name := f.Name()
+		if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ".body") {
+			continue
+		}
+		index := strings.TrimSuffix(strings.TrimPrefix(name, prefix), ".body")
+		if _, err := strconv.Atoi(index); err != nil {
+			continue
+		}
+		if _, ok := keep[name]; ok {
+			continue
+		}
+		if err := os.Remove(path.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
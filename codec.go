@@ -0,0 +1,165 @@
+package recorder
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"gopkg.in/yaml.v2"
+)
+
+// A Codec encodes and decodes the entries saved to disk.
+type Codec interface {
+	Encode(w io.Writer, entries []Entry) error
+	Decode(r io.Reader) ([]Entry, error)
+}
+
+// YAMLCodec is the default Codec. It saves entries as human readable YAML
+// documents, separated by ---.
+type YAMLCodec struct{}
+
+// Encode implements Codec.
+func (YAMLCodec) Encode(w io.Writer, entries []Entry) error {
+	var buf bytes.Buffer
+	for i, e := range entries {
+		if i > 0 {
+			fmt.Fprintf(&buf, "\n---\n\n")
+		}
+		fmt.Fprintf(&buf, "# request %d\n", i)
+		b, err := yaml.Marshal(e)
+		if err != nil {
+			return err
+		}
+		buf.Write(b)
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// separator returns the text that separates entries appended to already
+// encoded ones.
+func (YAMLCodec) separator() string { return "\n---\n\n" }
+
+// Decode implements Codec.
+func (YAMLCodec) Decode(r io.Reader) ([]Entry, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return parseEntries(b)
+}
+
+// GobCodec is a Codec that saves entries with encoding/gob. The files are not
+// human readable, but they are smaller and load considerably faster than
+// YAML. It is intended for large generated recordings that are not edited by
+// hand:
+//
+//     rec := recorder.New("testdata/large.gob")
+//     rec.Codec = recorder.GobCodec{}
+type GobCodec struct{}
+
+// Encode implements Codec.
+func (GobCodec) Encode(w io.Writer, entries []Entry) error {
+	return gob.NewEncoder(w).Encode(entries)
+}
+
+// Decode implements Codec.
+func (GobCodec) Decode(r io.Reader) ([]Entry, error) {
+	var entries []Entry
+	if err := gob.NewDecoder(r).Decode(&entries); err != nil {
+		if err == io.EOF {
+			// Empty file
+			return nil, nil
+		}
+		return nil, fmt.Errorf("decode gob: %v", err)
+	}
+	return entries, nil
+}
+
+// JSONCodec is a Codec that saves entries as an indented JSON array. The
+// files can be read and edited with JSON tools, such as jq:
+//
+//     rec := recorder.New("testdata/api.json")
+//     rec.Codec = recorder.JSONCodec{}
+type JSONCodec struct{}
+
+// Encode implements Codec.
+func (JSONCodec) Encode(w io.Writer, entries []Entry) error {
+	if entries == nil {
+		entries = []Entry{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	return enc.Encode(entries)
+}
+
+// Decode implements Codec.
+func (JSONCodec) Decode(r io.Reader) ([]Entry, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(bytes.TrimSpace(b)) == 0 {
+		// Empty file
+		return nil, nil
+	}
+	var entries []Entry
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return nil, fmt.Errorf("decode json: %v", err)
+	}
+	return entries, nil
+}
+
+// JSONLCodec is a Codec that saves entries as JSON lines, with one entry per
+// line. The files are easy to process with line based tools such as grep.
+// New entries are appended to the end of the file when recording, instead of
+// rewriting the whole file, which suits long running recording sessions:
+//
+//     rec := recorder.New("testdata/session.jsonl")
+//     rec.Codec = recorder.JSONLCodec{}
+//
+// Entries are only appended if Compress, PrettyJSON, BodyFileThreshold,
+// DryRun, OnWrite and Writer are not set. Otherwise the file is rewritten
+// like with other codecs.
+type JSONLCodec struct{}
+
+// Encode implements Codec.
+func (c JSONLCodec) Encode(w io.Writer, entries []Entry) error {
+	var buf bytes.Buffer
+	for _, e := range entries {
+		if err := c.appendEntry(&buf, e); err != nil {
+			return err
+		}
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// appendEntry writes a single entry as a line to w.
+func (JSONLCodec) appendEntry(w io.Writer, e Entry) error {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	return enc.Encode(e)
+}
+
+// separator implements appending to encoded entries. Lines need no separator.
+func (JSONLCodec) separator() string { return "" }
+
+// Decode implements Codec.
+func (JSONLCodec) Decode(r io.Reader) ([]Entry, error) {
+	var entries []Entry
+	dec := json.NewDecoder(r)
+	for {
+		var e Entry
+		if err := dec.Decode(&e); err == io.EOF {
+			return entries, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("decode entry %d: %v", len(entries), err)
+		}
+		entries = append(entries, e)
+	}
+}
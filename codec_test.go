@@ -0,0 +1,218 @@
+package recorder_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/akupila/recorder"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+func TestGobCodec(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprintf(w, "path %s", r.URL.Path)
+	}))
+	defer ts.Close()
+
+	rec := recorder.New("testdata/codec.gob")
+	rec.Codec = recorder.GobCodec{}
+	for _, p := range []string{"/a", "/b"} {
+		if _, err := rec.Client().Post(ts.URL+p, "text/plain", strings.NewReader("body")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	saved, err := ioutil.ReadFile("testdata/codec.gob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(saved, []byte("request:")) {
+		t.Error("Saved file is YAML")
+	}
+
+	rec2 := recorder.New("testdata/codec.gob")
+	rec2.Codec = recorder.GobCodec{}
+	rec2.Mode = recorder.ReplayOnly
+	if diff := cmp.Diff(rec2.Entries(), rec.Entries()); diff != "" {
+		t.Errorf("Loaded entries do not match (-got, +want)\n%s", diff)
+	}
+	resp, err := rec2.Client().Post(ts.URL+"/b", "text/plain", strings.NewReader("body"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "path /b" {
+		t.Errorf("Body = %q, want %q", body, "path /b")
+	}
+
+	// Empty files are tolerated
+	if err := ioutil.WriteFile("testdata/codec-empty.gob", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	rec3 := recorder.New("testdata/codec-empty.gob")
+	rec3.Codec = recorder.GobCodec{}
+	if n := len(rec3.Entries()); n != 0 {
+		t.Errorf("Got %d entries from empty file, want 0", n)
+	}
+}
+
+func TestJSONCodec(t *testing.T) {
+	removeRecording(t, "testdata/json-codec")
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "path %s", r.URL.Path)
+	}))
+	defer ts.Close()
+
+	const filename = "testdata/json-codec.json"
+	newRecorder := func() *recorder.Recorder {
+		rec := recorder.New(filename)
+		rec.Codec = recorder.JSONCodec{}
+		return rec
+	}
+	rec := newRecorder()
+	for _, p := range []string{"/a", "/b"} {
+		if _, err := rec.Client().Get(ts.URL + p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	saved, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var raw []map[string]interface{}
+	if err := json.Unmarshal(saved, &raw); err != nil {
+		t.Fatalf("Saved file is not a JSON array: %v\n%s", err, saved)
+	}
+	if len(raw) != 2 {
+		t.Errorf("Got %d saved entries, want 2", len(raw))
+	}
+
+	rec2 := newRecorder()
+	rec2.Mode = recorder.ReplayOnly
+	if diff := cmp.Diff(rec2.Entries(), rec.Entries(), cmpopts.EquateEmpty()); diff != "" {
+		t.Errorf("Loaded entries do not match (-got, +want)\n%s", diff)
+	}
+	resp, err := rec2.Client().Get(ts.URL + "/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "path /b" {
+		t.Errorf("Body = %q, want %q", body, "path /b")
+	}
+
+	// Empty files are tolerated
+	if err := ioutil.WriteFile("testdata/json-codec-empty.json", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	rec3 := recorder.New("testdata/json-codec-empty.json")
+	rec3.Codec = recorder.JSONCodec{}
+	if n := len(rec3.Entries()); n != 0 {
+		t.Errorf("Got %d entries from empty file, want 0", n)
+	}
+}
+
+func TestJSONLCodec(t *testing.T) {
+	removeRecording(t, "testdata/codec")
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "path %s", r.URL.Path)
+	}))
+	defer ts.Close()
+
+	const filename = "testdata/codec.jsonl"
+	newRecorder := func() *recorder.Recorder {
+		rec := recorder.New(filename)
+		rec.Codec = recorder.JSONLCodec{}
+		return rec
+	}
+	rec := newRecorder()
+	for _, p := range []string{"/a", "/b"} {
+		if _, err := rec.Client().Get(ts.URL + p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	saved, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(saved), "\n"), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[1], `"url":"`+ts.URL+`/b"`) {
+		t.Errorf("Saved file does not have one entry per line:\n%s", saved)
+	}
+
+	rec2 := newRecorder()
+	if diff := cmp.Diff(rec2.Entries(), rec.Entries(), cmpopts.EquateEmpty()); diff != "" {
+		t.Errorf("Loaded entries do not match (-got, +want)\n%s", diff)
+	}
+
+	// New entries are appended
+	if _, err := rec2.Client().Get(ts.URL + "/c"); err != nil {
+		t.Fatal(err)
+	}
+	appended, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(appended, saved) {
+		t.Errorf("Existing entries were modified:\n%s", appended)
+	}
+	if n := len(newRecorder().Entries()); n != 3 {
+		t.Errorf("Got %d saved entries, want 3", n)
+	}
+}
+
+func BenchmarkLoad(b *testing.B) {
+	entries := make([]recorder.Entry, 1000)
+	for i := range entries {
+		entries[i] = recorder.Entry{
+			Request: &recorder.Request{
+				Method:  "POST",
+				URL:     fmt.Sprintf("https://example.com/items/%d", i),
+				Headers: map[string]string{"Content-Type": "application/json", "Accept": "application/json"},
+				Body:    fmt.Sprintf(`{"id":%d,"name":"item %d"}`, i, i),
+			},
+			Response: &recorder.Response{
+				StatusCode: 200,
+				Headers:    map[string]string{"Content-Type": "application/json", "Date": "Wed, 01 May 2019 12:00:00 GMT"},
+				Body:       strings.Repeat(fmt.Sprintf(`{"id":%d,"value":"lorem ipsum dolor sit amet"},`, i), 20),
+			},
+			Timestamp: time.Date(2019, 5, 1, 12, 0, 0, 0, time.UTC),
+			Duration:  42 * time.Millisecond,
+		}
+	}
+
+	for _, codec := range []recorder.Codec{recorder.YAMLCodec{}, recorder.GobCodec{}, recorder.JSONCodec{}, recorder.JSONLCodec{}} {
+		var buf bytes.Buffer
+		if err := codec.Encode(&buf, entries); err != nil {
+			b.Fatal(err)
+		}
+		data := buf.Bytes()
+		b.Run(fmt.Sprintf("%T", codec), func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				if _, err := codec.Decode(bytes.NewReader(data)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
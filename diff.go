@@ -0,0 +1,156 @@
+package recorder
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DiffKind describes how an entry differs between two sets of entries.
+type DiffKind int
+
+// Possible values:
+const (
+	// EntryAdded is an entry that only exists in the second set.
+	EntryAdded DiffKind = iota
+
+	// EntryRemoved is an entry that only exists in the first set.
+	EntryRemoved
+
+	// EntryChanged is an entry that exists in both sets with different
+	// values.
+	EntryChanged
+)
+
+// String returns the name of the kind.
+func (k DiffKind) String() string {
+	switch k {
+	case EntryAdded:
+		return "added"
+	case EntryRemoved:
+		return "removed"
+	case EntryChanged:
+		return "changed"
+	}
+	return "DiffKind(" + strconv.Itoa(int(k)) + ")"
+}
+
+// An EntryDiff describes the difference of a single entry.
+type EntryDiff struct {
+	Kind   DiffKind
+	Method string
+	URL    string
+
+	// Fields contains the differing fields if Kind is EntryChanged.
+	Fields []FieldDiff
+}
+
+// A FieldDiff is a single differing field in an entry.
+//
+// Field is the path to the field, such as Response.Body or
+// Request.Headers.Content-Type. A is the value in the first set and B is the
+// value in the second set. Missing headers have an empty value.
+type FieldDiff struct {
+	Field string
+	A, B  string
+}
+
+// Diff compares two sets of entries, such as two recordings of the same
+// test, and returns the differences.
+//
+// Entries are matched by method and URL. If several entries have the same
+// method and URL, they are matched in the order they appear. The result is
+// sorted by URL and method, and field differences are sorted by field.
+func Diff(a, b []Entry) []EntryDiff {
+	type key struct{ method, url string }
+	group := func(entries []Entry) (map[key][]Entry, []key) {
+		m := map[key][]Entry{}
+		var keys []key
+		for _, e := range entries {
+			if e.Request == nil {
+				continue
+			}
+			k := key{strings.ToUpper(e.Request.Method), canonicalURL(e.Request.URL)}
+			if _, ok := m[k]; !ok {
+				keys = append(keys, k)
+			}
+			m[k] = append(m[k], e)
+		}
+		return m, keys
+	}
+	ga, keys := group(a)
+	gb, keysB := group(b)
+	for _, k := range keysB {
+		if _, ok := ga[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].url != keys[j].url {
+			return keys[i].url < keys[j].url
+		}
+		return keys[i].method < keys[j].method
+	})
+
+	var out []EntryDiff
+	for _, k := range keys {
+		ea, eb := ga[k], gb[k]
+		for i := 0; i < len(ea) || i < len(eb); i++ {
+			d := EntryDiff{Method: k.method, URL: k.url}
+			switch {
+			case i >= len(ea):
+				d.Kind = EntryAdded
+			case i >= len(eb):
+				d.Kind = EntryRemoved
+			default:
+				d.Kind = EntryChanged
+				d.Fields = diffEntry(ea[i], eb[i])
+				if len(d.Fields) == 0 {
+					continue
+				}
+			}
+			out = append(out, d)
+		}
+	}
+	return out
+}
+
+func diffEntry(a, b Entry) []FieldDiff {
+	var out []FieldDiff
+	add := func(field, x, y string) {
+		if x != y {
+			out = append(out, FieldDiff{Field: field, A: x, B: y})
+		}
+	}
+	addHeaders := func(prefix string, x, y map[string]string) {
+		for k, v := range x {
+			add(prefix+k, v, y[k])
+		}
+		for k, v := range y {
+			if _, ok := x[k]; !ok {
+				add(prefix+k, "", v)
+			}
+		}
+	}
+
+	ra, rb := a.Request, b.Request
+	addHeaders("Request.Headers.", ra.Headers, rb.Headers)
+	add("Request.Body", ra.Body, rb.Body)
+	add("Request.BodyHash", ra.BodyHash, rb.BodyHash)
+
+	sa, sb := a.Response, b.Response
+	if sa == nil {
+		sa = &Response{}
+	}
+	if sb == nil {
+		sb = &Response{}
+	}
+	add("Response.StatusCode", strconv.Itoa(sa.StatusCode), strconv.Itoa(sb.StatusCode))
+	addHeaders("Response.Headers.", sa.Headers, sb.Headers)
+	add("Response.Body", sa.Body, sb.Body)
+	add("Response.BodyHash", sa.BodyHash, sb.BodyHash)
+	add("Error", a.Error, b.Error)
+
+	sort.Slice(out, func(i, j int) bool { return out[i].Field < out[j].Field })
+	return out
+}
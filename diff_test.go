@@ -0,0 +1,78 @@
+package recorder_test
+
+import (
+	"testing"
+
+	"github.com/akupila/recorder"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDiff(t *testing.T) {
+	a := []recorder.Entry{
+		{
+			Request:  &recorder.Request{Method: "GET", URL: "http://foo.com/b"},
+			Response: &recorder.Response{StatusCode: 200, Body: "b"},
+		},
+		{
+			Request: &recorder.Request{Method: "POST", URL: "http://foo.com/a", Body: "1"},
+			Response: &recorder.Response{
+				StatusCode: 200,
+				Headers:    map[string]string{"Content-Type": "text/plain", "Date": "today"},
+				Body:       "a",
+			},
+		},
+		{
+			Request:  &recorder.Request{Method: "GET", URL: "http://foo.com/removed"},
+			Response: &recorder.Response{StatusCode: 200},
+		},
+	}
+	b := []recorder.Entry{
+		{
+			Request:  &recorder.Request{Method: "GET", URL: "http://foo.com/added"},
+			Response: &recorder.Response{StatusCode: 200},
+		},
+		{
+			Request: &recorder.Request{Method: "POST", URL: "http://foo.com/a", Body: "2"},
+			Response: &recorder.Response{
+				StatusCode: 201,
+				Headers:    map[string]string{"Content-Type": "application/json", "Location": "/a/1"},
+				Body:       "a",
+			},
+		},
+		{
+			Request:  &recorder.Request{Method: "GET", URL: "http://foo.com/b"},
+			Response: &recorder.Response{StatusCode: 200, Body: "b"},
+		},
+		{
+			Request:  &recorder.Request{Method: "GET", URL: "http://foo.com/b"},
+			Response: &recorder.Response{StatusCode: 200, Body: "b again"},
+		},
+	}
+
+	want := []recorder.EntryDiff{
+		{
+			Kind:   recorder.EntryChanged,
+			Method: "POST",
+			URL:    "http://foo.com/a",
+			Fields: []recorder.FieldDiff{
+				{Field: "Request.Body", A: "1", B: "2"},
+				{Field: "Response.Headers.Content-Type", A: "text/plain", B: "application/json"},
+				{Field: "Response.Headers.Date", A: "today", B: ""},
+				{Field: "Response.Headers.Location", A: "", B: "/a/1"},
+				{Field: "Response.StatusCode", A: "200", B: "201"},
+			},
+		},
+		{Kind: recorder.EntryAdded, Method: "GET", URL: "http://foo.com/added"},
+		{Kind: recorder.EntryAdded, Method: "GET", URL: "http://foo.com/b"},
+		{Kind: recorder.EntryRemoved, Method: "GET", URL: "http://foo.com/removed"},
+	}
+
+	got := recorder.Diff(a, b)
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("Diff does not match (-got, +want)\n%s", diff)
+	}
+
+	if got := recorder.Diff(a, a); len(got) != 0 {
+		t.Errorf("Diff of identical entries = %v, want none", got)
+	}
+}
@@ -0,0 +1,304 @@
+package recorder
+
+import (
+	"bytes"
+	"crypto"
+	_ "crypto/md5"    // register hash function
+	_ "crypto/sha1"   // register hash function
+	_ "crypto/sha256" // register hash function
+	_ "crypto/sha512" // register hash function
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// A Filter modifies the entry before it is saved to disk.
+//
+// Filters are applied after the actual request, with the primary purpose
+// being to remove sensitive data from the saved file. If a filter panics, the
+// entry is not recorded and the request fails with a FilterError. Filters
+// are also applied to incoming requests before matching, as described in
+// Recorder.Filters.
+type Filter func(entry *Entry)
+
+// A RawFilter modifies the entry before it is saved to disk, like Filter. It
+// also receives the original request and response, which contain information
+// that is not in the entry, such as all values of repeated headers or the TLS
+// connection state. The bodies have already been read and must not be read
+// again. The response is nil if the request failed.
+type RawFilter func(entry *Entry, req *http.Request, resp *http.Response)
+
+// RemoveRequestHeader removes a header with the given name from the request.
+// The name of the header is case-sensitive.
+func RemoveRequestHeader(name string) Filter {
+	return func(e *Entry) {
+		delete(e.Request.Headers, name)
+	}
+}
+
+// RemoveResponseHeader removes a header with the given name from the response.
+// The name of the header is case-sensitive.
+func RemoveResponseHeader(name string) Filter {
+	return func(e *Entry) {
+		if e.Response != nil {
+			delete(e.Response.Headers, name)
+		}
+	}
+}
+
+// KeepRequestHeaders removes all headers from the request except the given
+// ones. The names of the headers are case-insensitive. This is safer than
+// removing sensitive headers one by one, as new headers are never recorded
+// by accident.
+func KeepRequestHeaders(names ...string) Filter {
+	return func(e *Entry) {
+		keepHeaders(e.Request.Headers, names)
+	}
+}
+
+// KeepResponseHeaders removes all headers from the response except the given
+// ones. The names of the headers are case-insensitive.
+func KeepResponseHeaders(names ...string) Filter {
+	return func(e *Entry) {
+		if e.Response != nil {
+			keepHeaders(e.Response.Headers, names)
+		}
+	}
+}
+
+func keepHeaders(headers map[string]string, names []string) {
+	for k := range headers {
+		if !containsFold(names, k) {
+			delete(headers, k)
+		}
+	}
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// RewriteRequestURL replaces the request URL with the result of calling
+// rewrite with it. The rewritten URL is saved and used for matching when
+// replaying. This allows reusing recordings made against another
+// environment:
+//
+//     recorder.RewriteRequestURL(func(u string) string {
+//         return strings.Replace(u, "://staging.api.example.com/", "://api.example.com/", 1)
+//     })
+func RewriteRequestURL(rewrite func(url string) string) Filter {
+	return func(e *Entry) {
+		e.Request.URL = rewrite(e.Request.URL)
+	}
+}
+
+// RemoveQueryParam removes a query parameter with the given name from the
+// request URL. The name of the parameter is case-sensitive. The order of the
+// remaining parameters is preserved. Requests are matched with the parameter
+// removed, so they replay the recorded entry whatever its value.
+func RemoveQueryParam(name string) Filter {
+	return func(e *Entry) {
+		u, err := url.Parse(e.Request.URL)
+		if err != nil || u.RawQuery == "" {
+			return
+		}
+		var keep []string
+		for _, kv := range strings.Split(u.RawQuery, "&") {
+			k := kv
+			if i := strings.Index(kv, "="); i >= 0 {
+				k = kv[:i]
+			}
+			if key, err := url.QueryUnescape(k); err == nil && key == name {
+				continue
+			}
+			keep = append(keep, kv)
+		}
+		u.RawQuery = strings.Join(keep, "&")
+		e.Request.URL = u.String()
+	}
+}
+
+// RedactBasicAuth replaces the credentials of a basic Authorization header in
+// the request with <redacted>. The scheme is kept, so it's still possible to
+// tell that the request was authenticated. Other authorization schemes are
+// left as is. Requests are matched with the credentials redacted, so any basic
+// credentials replay the recorded entry.
+func RedactBasicAuth() Filter {
+	return func(e *Entry) {
+		for k, v := range e.Request.Headers {
+			if !strings.EqualFold(k, "Authorization") {
+				continue
+			}
+			if i := strings.IndexByte(v, ' '); i >= 0 && strings.EqualFold(v[:i], "Basic") {
+				e.Request.Headers[k] = v[:i] + " <redacted>"
+			}
+		}
+	}
+}
+
+// NormalizeMultipartBoundary replaces the randomly generated boundaries of
+// multipart request bodies with deterministic values, so the recorded body is
+// the same between runs. The boundary is replaced in both the Content-Type
+// header and the body, including boundaries of nested multipart parts.
+// Requests that are not multipart are not modified. The boundaries of
+// incoming requests are normalized the same way before matching.
+func NormalizeMultipartBoundary() Filter {
+	return func(e *Entry) {
+		for k, v := range e.Request.Headers {
+			if !strings.EqualFold(k, "Content-Type") {
+				continue
+			}
+			mt, params, err := mime.ParseMediaType(v)
+			if err != nil || !strings.HasPrefix(mt, "multipart/") || params["boundary"] == "" {
+				return
+			}
+			e.Request.Body, params["boundary"] = normalizeBoundaries(e.Request.Body, params["boundary"])
+			e.Request.Headers[k] = mime.FormatMediaType(mt, params)
+			return
+		}
+	}
+}
+
+// boundaryPrefix is the prefix of the boundaries set by
+// NormalizeMultipartBoundary.
+const boundaryPrefix = "recorder-boundary-"
+
+// normalizeBoundaries replaces the boundary and any nested boundaries in the
+// body with deterministic values. Returns the body and the new boundary.
+func normalizeBoundaries(body, boundary string) (string, string) {
+	boundaries := []string{boundary}
+	boundaries = append(boundaries, nestedBoundaries(body, boundary)...)
+
+	// Replace longest first, in case a boundary contains another
+	replace := make(map[string]string, len(boundaries))
+	for i, b := range boundaries {
+		replace[b] = fmt.Sprintf("%s%d", boundaryPrefix, i)
+	}
+	sort.Slice(boundaries, func(i, j int) bool { return len(boundaries[i]) > len(boundaries[j]) })
+	for _, b := range boundaries {
+		body = strings.Replace(body, b, replace[b], -1)
+	}
+	return body, replace[boundary]
+}
+
+// normalizeMultipartBody normalizes the boundaries of an incoming multipart
+// body if the recorded body was normalized with NormalizeMultipartBoundary.
+// The boundary is taken from the first line of the body. Other bodies are
+// returned as is.
+func normalizeMultipartBody(recorded string, body []byte) []byte {
+	if !strings.HasPrefix(recorded, "--"+boundaryPrefix) || !bytes.HasPrefix(body, []byte("--")) {
+		return body
+	}
+	i := bytes.Index(body, []byte("\r\n"))
+	if i < 3 {
+		return body
+	}
+	normalized, _ := normalizeBoundaries(string(body), string(body[2:i]))
+	return []byte(normalized)
+}
+
+// nestedBoundaries returns the boundaries of any multipart parts in the body.
+func nestedBoundaries(body, boundary string) []string {
+	var out []string
+	mr := multipart.NewReader(strings.NewReader(body), boundary)
+	for {
+		p, err := mr.NextPart()
+		if err != nil {
+			return out
+		}
+		mt, params, err := mime.ParseMediaType(p.Header.Get("Content-Type"))
+		if err != nil || !strings.HasPrefix(mt, "multipart/") || params["boundary"] == "" {
+			continue
+		}
+		var sb strings.Builder
+		if _, err := io.Copy(&sb, p); err != nil {
+			return out
+		}
+		out = append(out, params["boundary"])
+		out = append(out, nestedBoundaries(sb.String(), params["boundary"])...)
+	}
+}
+
+var hashNames = map[crypto.Hash]string{
+	crypto.MD5:    "md5",
+	crypto.SHA1:   "sha1",
+	crypto.SHA256: "sha256",
+	crypto.SHA512: "sha512",
+}
+
+// HashRequestBody replaces the body of the request with a hash of it, for
+// payloads that must not be saved to disk. The hash is saved as BodyHash in
+// the form algorithm:hex, such as sha256:2c26b4...
+//
+// Requests with a hashed body are matched by hashing the body of the incoming
+// request when bodies are compared, either with a BodyMatcher or in
+// ReplayOrRecord mode. The body must then be identical to the recorded one.
+//
+// Supported hash functions are crypto.MD5, crypto.SHA1, crypto.SHA256 and
+// crypto.SHA512. HashRequestBody panics if called with another one.
+func HashRequestBody(h crypto.Hash) Filter {
+	checkHash(h)
+	return func(e *Entry) {
+		if e.Request.Body == "" {
+			return
+		}
+		e.Request.BodyHash = hashBody(h, []byte(e.Request.Body))
+		e.Request.Body = ""
+	}
+}
+
+// HashResponseBody replaces the body of the response with a hash of it. This
+// is useful when the content of the response is sensitive, but it matters
+// whether it changes, such as in Verify mode. Replayed responses have an
+// empty body.
+//
+// The supported hash functions are the same as for HashRequestBody.
+func HashResponseBody(h crypto.Hash) Filter {
+	checkHash(h)
+	return func(e *Entry) {
+		if e.Response == nil || e.Response.Body == "" {
+			return
+		}
+		e.Response.BodyHash = hashBody(h, []byte(e.Response.Body))
+		e.Response.Body = ""
+		e.Response.Chunks = nil
+	}
+}
+
+func checkHash(h crypto.Hash) {
+	if _, ok := hashNames[h]; !ok {
+		panic(fmt.Sprintf("recorder: unsupported hash function %d", h))
+	}
+}
+
+func hashBody(h crypto.Hash, body []byte) string {
+	hh := h.New()
+	hh.Write(body) // nolint: errcheck
+	return hashNames[h] + ":" + hex.EncodeToString(hh.Sum(nil))
+}
+
+// matchBodyHash reports whether body has the given hash, as created by
+// hashBody.
+func matchBodyHash(hash string, body []byte) bool {
+	name := hash
+	if i := strings.Index(hash, ":"); i >= 0 {
+		name = hash[:i]
+	}
+	for h, n := range hashNames {
+		if n == name {
+			return hashBody(h, body) == hash
+		}
+	}
+	return false
+}
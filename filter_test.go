@@ -0,0 +1,454 @@
+package recorder_test
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/akupila/recorder"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRemoveQueryParam(t *testing.T) {
+	testcases := []struct {
+		URL, Want string
+	}{
+		{"https://example.com/?api_key=secret", "https://example.com/"},
+		{"https://example.com/?a=1&api_key=secret&b=2", "https://example.com/?a=1&b=2"},
+		{"https://example.com/?b=2&a=1&api_key=x&api_key=y", "https://example.com/?b=2&a=1"},
+		{"https://example.com/?api%5Fkey=secret&c=%20", "https://example.com/?c=%20"},
+		{"https://example.com/?other=1", "https://example.com/?other=1"},
+		{"https://example.com/path", "https://example.com/path"},
+	}
+
+	filter := recorder.RemoveQueryParam("api_key")
+
+	for _, test := range testcases {
+		e := &recorder.Entry{Request: &recorder.Request{URL: test.URL}}
+		filter(e)
+		if e.Request.URL != test.Want {
+			t.Errorf("RemoveQueryParam(%q) = %q, want %q", test.URL, e.Request.URL, test.Want)
+		}
+	}
+}
+
+func TestRemoveQueryParamReplay(t *testing.T) {
+	var requests int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+
+	removeRecording(t, "testdata/remove-query-param")
+	for _, mode := range []recorder.Mode{recorder.Auto, recorder.ReplayOnly} {
+		rec := recorder.New("testdata/remove-query-param", recorder.RemoveQueryParam("api_key"))
+		rec.Mode = mode
+		resp, err := rec.Client().Get(ts.URL + "/?a=1&api_key=secret")
+		if err != nil {
+			t.Fatalf("%v: %v", mode, err)
+		}
+		resp.Body.Close()
+		if got, want := rec.Entries()[0].Request.URL, ts.URL+"/?a=1"; got != want {
+			t.Errorf("%v: URL = %q, want %q", mode, got, want)
+		}
+	}
+	if requests != 1 {
+		t.Errorf("Got %d outgoing requests, want 1", requests)
+	}
+}
+
+func TestRedactBasicAuth(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, _, ok := r.BasicAuth(); !ok {
+			t.Errorf("Request was not sent with credentials")
+		}
+	}))
+	defer ts.Close()
+
+	rec := recorder.New("testdata/basic-auth", recorder.RedactBasicAuth())
+	cli := &http.Client{Transport: rec}
+
+	req, _ := http.NewRequest(http.MethodGet, ts.URL, nil)
+	req.SetBasicAuth("user", "secret")
+	if _, err := cli.Do(req); err != nil {
+		t.Fatal(err)
+	}
+
+	saved, err := ioutil.ReadFile("testdata/basic-auth.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(saved, []byte("Authorization: Basic <redacted>")) {
+		t.Errorf("Saved file does not contain redacted auth header\n\n%s", saved)
+	}
+	if creds := base64.StdEncoding.EncodeToString([]byte("user:secret")); bytes.Contains(saved, []byte(creds)) {
+		t.Errorf("Saved file contains credentials\n\n%s", saved)
+	}
+
+	// Other schemes are kept
+	e := &recorder.Entry{Request: &recorder.Request{Headers: map[string]string{"Authorization": "Bearer abc"}}}
+	recorder.RedactBasicAuth()(e)
+	if got := e.Request.Headers["Authorization"]; got != "Bearer abc" {
+		t.Errorf("Bearer authorization = %q, want unchanged", got)
+	}
+}
+
+func TestRedactBasicAuthReplay(t *testing.T) {
+	var requests int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+
+	removeRecording(t, "testdata/basic-auth-replay")
+	for _, user := range []string{"user", "other"} {
+		rec := recorder.New("testdata/basic-auth-replay", recorder.RedactBasicAuth())
+		rec.Mode = recorder.ReplayOrRecord
+		req, _ := http.NewRequest(http.MethodGet, ts.URL, nil)
+		req.SetBasicAuth(user, "secret")
+		resp, err := rec.Client().Do(req)
+		if err != nil {
+			t.Fatalf("%s: %v", user, err)
+		}
+		resp.Body.Close()
+	}
+	if requests != 1 {
+		t.Errorf("Got %d outgoing requests, want 1", requests)
+	}
+}
+
+func TestNormalizeMultipartBoundary(t *testing.T) {
+	build := func(outer, inner string) (string, string) {
+		var buf bytes.Buffer
+		w := multipart.NewWriter(&buf)
+		if outer != "" {
+			if err := w.SetBoundary(outer); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.WriteField("name", "test"); err != nil {
+			t.Fatal(err)
+		}
+
+		var nested bytes.Buffer
+		nw := multipart.NewWriter(&nested)
+		if inner != "" {
+			if err := nw.SetBoundary(inner); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := nw.WriteField("inner", "value"); err != nil {
+			t.Fatal(err)
+		}
+		if err := nw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		pw, err := w.CreatePart(textproto.MIMEHeader{
+			"Content-Type": {"multipart/mixed; boundary=" + nw.Boundary()},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := pw.Write(nested.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return w.FormDataContentType(), buf.String()
+	}
+
+	filter := recorder.NormalizeMultipartBoundary()
+
+	var bodies, contentTypes []string
+	for _, b := range [][2]string{{"", ""}, {"", ""}, {"quoted:boundary", ""}} {
+		ct, body := build(b[0], b[1])
+		e := &recorder.Entry{Request: &recorder.Request{
+			Headers: map[string]string{"Content-Type": ct},
+			Body:    body,
+		}}
+		filter(e)
+		contentTypes = append(contentTypes, e.Request.Headers["Content-Type"])
+		bodies = append(bodies, e.Request.Body)
+	}
+
+	for i := 1; i < len(bodies); i++ {
+		if contentTypes[i] != contentTypes[0] {
+			t.Errorf("Content-Type %d = %q, want %q", i, contentTypes[i], contentTypes[0])
+		}
+		if bodies[i] != bodies[0] {
+			t.Errorf("Body %d differs\n\n%s\n\n%s", i, bodies[i], bodies[0])
+		}
+	}
+	if want := "multipart/form-data; boundary=recorder-boundary-0"; contentTypes[0] != want {
+		t.Errorf("Content-Type = %q, want %q", contentTypes[0], want)
+	}
+
+	// The normalized body is still valid
+	mr := multipart.NewReader(strings.NewReader(bodies[0]), "recorder-boundary-0")
+	form, err := mr.ReadForm(1024)
+	if err != nil {
+		t.Fatalf("Read normalized body: %v", err)
+	}
+	if got := form.Value["name"]; len(got) != 1 || got[0] != "test" {
+		t.Errorf("Form value name = %v, want [test]", got)
+	}
+
+	// Other requests are not modified
+	e := &recorder.Entry{Request: &recorder.Request{
+		Headers: map[string]string{"Content-Type": "application/json"},
+		Body:    `{"boundary":"x"}`,
+	}}
+	filter(e)
+	if e.Request.Body != `{"boundary":"x"}` || e.Request.Headers["Content-Type"] != "application/json" {
+		t.Errorf("Non-multipart request was modified: %+v", e.Request)
+	}
+}
+
+func TestNormalizeMultipartBoundaryReplay(t *testing.T) {
+	var requests int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+
+	removeRecording(t, "testdata/multipart-replay")
+	for i := 0; i < 2; i++ {
+		// Each writer uses a new random boundary
+		var buf bytes.Buffer
+		w := multipart.NewWriter(&buf)
+		if err := w.WriteField("name", "test"); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		rec := recorder.New("testdata/multipart-replay", recorder.NormalizeMultipartBoundary())
+		rec.Mode = recorder.ReplayOrRecord
+		resp, err := rec.Client().Post(ts.URL, w.FormDataContentType(), &buf)
+		if err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+		resp.Body.Close()
+	}
+	if requests != 1 {
+		t.Errorf("Got %d outgoing requests, want 1", requests)
+	}
+}
+
+func TestHashBody(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("secret response"))
+	}))
+	defer ts.Close()
+
+	rec := recorder.New("testdata/hash-body", recorder.HashRequestBody(crypto.SHA256), recorder.HashResponseBody(crypto.SHA256))
+	rec.Mode = recorder.Record
+	if _, err := rec.Client().Post(ts.URL, "text/plain", strings.NewReader("secret request")); err != nil {
+		t.Fatal(err)
+	}
+
+	saved, err := ioutil.ReadFile("testdata/hash-body.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(saved, []byte("secret")) {
+		t.Errorf("Saved file contains body\n\n%s", saved)
+	}
+	e := rec.Entries()[0]
+	if want := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte("secret request"))); e.Request.BodyHash != want {
+		t.Errorf("Request.BodyHash = %q, want %q", e.Request.BodyHash, want)
+	}
+	if want := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte("secret response"))); e.Response.BodyHash != want {
+		t.Errorf("Response.BodyHash = %q, want %q", e.Response.BodyHash, want)
+	}
+
+	// Incoming bodies are hashed for matching
+	rec = recorder.New("testdata/hash-body")
+	rec.Mode = recorder.ReplayOnly
+	rec.BodyMatcher = recorder.ExactBody{}
+	if _, err := rec.Client().Post(ts.URL, "text/plain", strings.NewReader("secret request")); err != nil {
+		t.Errorf("Replay with same body: %v", err)
+	}
+	if _, err := rec.Client().Post(ts.URL, "text/plain", strings.NewReader("other request")); err == nil {
+		t.Error("Replay with different body: expected error")
+	}
+}
+
+func TestRewriteRequestURL(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("recorded"))
+	}))
+	defer ts.Close()
+
+	rewrite := recorder.RewriteRequestURL(func(u string) string {
+		return strings.Replace(u, ts.URL, "https://api.example.com", 1)
+	})
+	rec := recorder.New("testdata/rewrite-url", rewrite)
+	if _, err := rec.Client().Get(ts.URL + "/users?page=2"); err != nil {
+		t.Fatal(err)
+	}
+
+	rec = recorder.New("testdata/rewrite-url")
+	rec.Mode = recorder.ReplayOnly
+	if got, want := rec.Entries()[0].Request.URL, "https://api.example.com/users?page=2"; got != want {
+		t.Errorf("Saved URL = %q, want %q", got, want)
+	}
+	resp, err := rec.Client().Get("https://api.example.com/users?page=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "recorded" {
+		t.Errorf("Body = %q, want %q", body, "recorded")
+	}
+}
+
+func TestKeepHeaders(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Set-Cookie", "session=secret")
+		w.Write([]byte("tenant " + r.Header.Get("X-Tenant")))
+	}))
+	defer ts.Close()
+
+	rec := recorder.New("testdata/keep-headers",
+		recorder.KeepRequestHeaders("x-tenant"),
+		recorder.KeepResponseHeaders("CONTENT-TYPE"),
+	)
+	rec.Mode = recorder.Record
+	for _, tenant := range []string{"a", "b"} {
+		req, _ := http.NewRequest("GET", ts.URL, nil)
+		req.Header.Set("X-Tenant", tenant)
+		req.Header.Set("Authorization", "Bearer secret")
+		if _, err := rec.Client().Do(req); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rec = recorder.New("testdata/keep-headers")
+	rec.Mode = recorder.ReplayOnly
+	rec.Selector = recorder.HeaderSelector("X-Tenant")
+	e := rec.Entries()[0]
+	if diff := cmp.Diff(e.Request.Headers, map[string]string{"X-Tenant": "a"}); diff != "" {
+		t.Errorf("Request headers do not match (-got, +want)\n%s", diff)
+	}
+	if diff := cmp.Diff(e.Response.Headers, map[string]string{"Content-Type": "text/plain"}); diff != "" {
+		t.Errorf("Response headers do not match (-got, +want)\n%s", diff)
+	}
+
+	// Kept headers are still used for matching
+	req, _ := http.NewRequest("GET", ts.URL, nil)
+	req.Header.Set("X-Tenant", "b")
+	resp, err := rec.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	if string(body) != "tenant b" {
+		t.Errorf("Body = %q, want %q", body, "tenant b")
+	}
+}
+
+func TestRawFilters(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Set-Cookie", "a=1")
+		w.Header().Add("Set-Cookie", "session=secret")
+		w.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+
+	var calls []string
+	rec := recorder.New("testdata/raw-filters", func(e *recorder.Entry) {
+		calls = append(calls, "filter")
+	})
+	rec.RawFilters = []recorder.RawFilter{
+		func(e *recorder.Entry, req *http.Request, resp *http.Response) {
+			calls = append(calls, "raw")
+			if req.URL.String() != e.Request.URL {
+				t.Errorf("Request URL = %q, want %q", req.URL, e.Request.URL)
+			}
+			// Remove the header if any value is sensitive
+			for _, c := range resp.Cookies() {
+				if c.Name == "session" {
+					delete(e.Response.Headers, "Set-Cookie")
+				}
+			}
+		},
+	}
+	resp, err := rec.Client().Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Filters are applied to the request for matching, and again when recording
+	if diff := cmp.Diff(calls, []string{"filter", "filter", "raw"}); diff != "" {
+		t.Errorf("Calls do not match (-got, +want)\n%s", diff)
+	}
+	if v := resp.Header.Get("Set-Cookie"); v != "" {
+		t.Errorf("Returned Set-Cookie %q, want filtered", v)
+	}
+	if v, ok := rec.Entries()[0].Response.Headers["Set-Cookie"]; ok {
+		t.Errorf("Recorded Set-Cookie %q, want filtered", v)
+	}
+}
+
+func TestPanickingFilter(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	url := ts.URL + "/failed"
+	ts.Close()
+
+	rec := recorder.New("testdata/panicking-filter",
+		recorder.RemoveRequestHeader("Authorization"),
+		func(e *recorder.Entry) {
+			// Panics for failed requests, which have no response
+			delete(e.Response.Headers, "Set-Cookie")
+		},
+	)
+	rec.RecordErrors = true
+	_, err := rec.Client().Get(url)
+	var fe recorder.FilterError
+	if !errors.As(err, &fe) {
+		t.Fatalf("Got error %v, want FilterError", err)
+	}
+	if fe.Index != 1 || fe.Raw {
+		t.Errorf("Failed filter = %d (raw %t), want 1", fe.Index, fe.Raw)
+	}
+	if fe.Entry.Request == nil || fe.Entry.Request.URL != url || fe.Entry.Error == "" {
+		t.Errorf("Entry = %+v, want failed request to %s", fe.Entry, url)
+	}
+	if want := "Filters[1] panicked for GET " + url; !strings.Contains(err.Error(), want) {
+		t.Errorf("Error %q does not contain %q", err, want)
+	}
+	if n := len(rec.Entries()); n != 0 {
+		t.Errorf("Got %d entries, want 0", n)
+	}
+
+	rec = recorder.New("testdata/panicking-filter")
+	rec.RecordErrors = true
+	rec.RawFilters = []recorder.RawFilter{
+		func(e *recorder.Entry, req *http.Request, resp *http.Response) {
+			resp.Header.Get("Set-Cookie")
+		},
+	}
+	_, err = rec.Client().Get(url)
+	if !errors.As(err, &fe) || fe.Index != 0 || !fe.Raw {
+		t.Errorf("Got error %v, want FilterError for RawFilters[0]", err)
+	}
+}
@@ -0,0 +1,107 @@
+package recorder
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"mime"
+	"strings"
+)
+
+// A Frame is a length-prefixed message in a gRPC-Web body.
+type Frame struct {
+	// Flag is the flag byte of the frame. It is 0 for messages and 0x80 for
+	// trailers, with the lowest bit set if the message is compressed.
+	Flag byte `yaml:"flag" json:"flag"`
+
+	// Data is the base64 encoded message.
+	Data string `yaml:"data" json:"data"`
+}
+
+// isGRPCWeb reports whether the content type is a binary gRPC-Web body.
+// The base64 encoded grpc-web-text format is already readable.
+func isGRPCWeb(contentType string) bool {
+	mt, _, err := mime.ParseMediaType(contentType)
+	return err == nil && (mt == "application/grpc-web" || strings.HasPrefix(mt, "application/grpc-web+"))
+}
+
+// splitFrames splits a gRPC-Web body into frames. Returns false if the body
+// is not a sequence of complete frames.
+func splitFrames(body string) ([]Frame, bool) {
+	var frames []Frame
+	b := []byte(body)
+	for len(b) > 0 {
+		if len(b) < 5 {
+			return nil, false
+		}
+		n := binary.BigEndian.Uint32(b[1:5])
+		if uint64(len(b)-5) < uint64(n) {
+			return nil, false
+		}
+		frames = append(frames, Frame{
+			Flag: b[0],
+			Data: base64.StdEncoding.EncodeToString(b[5 : 5+n]),
+		})
+		b = b[5+n:]
+	}
+	return frames, len(frames) > 0
+}
+
+// joinFrames reassembles a body split with splitFrames.
+func joinFrames(frames []Frame) (string, error) {
+	var buf bytes.Buffer
+	for _, f := range frames {
+		data, err := base64.StdEncoding.DecodeString(f.Data)
+		if err != nil {
+			return "", err
+		}
+		var prefix [5]byte
+		prefix[0] = f.Flag
+		binary.BigEndian.PutUint32(prefix[1:], uint32(len(data)))
+		buf.Write(prefix[:])
+		buf.Write(data)
+	}
+	return buf.String(), nil
+}
+
+// withFrames returns a copy of the entry with gRPC-Web bodies stored in
+// Frames instead of Body.
+func withFrames(e Entry) Entry {
+	if req := e.Request; req != nil && isGRPCWeb(req.Header("Content-Type")) {
+		if frames, ok := splitFrames(req.Body); ok {
+			out := *req
+			out.Frames, out.Body = frames, ""
+			e.Request = &out
+		}
+	}
+	if resp := e.Response; resp != nil && isGRPCWeb(resp.Header("Content-Type")) {
+		if frames, ok := splitFrames(resp.Body); ok {
+			out := *resp
+			out.Frames, out.Body = frames, ""
+			e.Response = &out
+		}
+	}
+	return e
+}
+
+// fromFrames moves bodies stored in Frames to Body.
+func fromFrames(entries []Entry) error {
+	for i, e := range entries {
+		if req := e.Request; req != nil && req.Frames != nil {
+			body, err := joinFrames(req.Frames)
+			if err != nil {
+				return fmt.Errorf("decode request frames of entry %d: %v", i, err)
+			}
+			req.Body, req.Frames = body, nil
+		}
+		if resp := e.Response; resp != nil && resp.Frames != nil {
+			body, err := joinFrames(resp.Frames)
+			if err != nil {
+				return fmt.Errorf("decode response frames of entry %d: %v", i, err)
+			}
+			resp.Body, resp.Frames = body, nil
+		}
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package recorder_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/akupila/recorder"
+)
+
+func TestGRPCWebFrames(t *testing.T) {
+	message := []byte{0, 0, 0, 0, 3, 0x08, 0x96, 0x01}
+	trailer := append([]byte{0x80, 0, 0, 0, 15}, "grpc-status:0\r\n"...)
+	bodies := map[string][]byte{
+		"/frames":    append(append([]byte{}, message...), trailer...),
+		"/truncated": message[:6],
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/grpc-web+proto")
+		w.Write(bodies[r.URL.Path])
+	}))
+	defer ts.Close()
+
+	rec := recorder.New("testdata/grpc-web")
+	rec.GRPCWebFrames = true
+	for _, p := range []string{"/frames", "/truncated"} {
+		resp, err := rec.Client().Post(ts.URL+p, "application/grpc-web+proto", bytes.NewReader(message))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	data, err := ioutil.ReadFile("testdata/grpc-web.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"flag: 128", "data: CJYB", "data: Z3JwYy1zdGF0dXM6MA0K"} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("Saved file does not contain %q\n%s", want, data)
+		}
+	}
+
+	rec = recorder.New("testdata/grpc-web")
+	rec.Mode = recorder.ReplayOnly
+	for p, want := range bodies {
+		resp, err := rec.Client().Post(ts.URL+p, "application/grpc-web+proto", bytes.NewReader(message))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(body, want) {
+			t.Errorf("%s: Body = %v, want %v", p, body, want)
+		}
+	}
+	for _, e := range rec.Entries() {
+		if e.Request.Body != string(message) {
+			t.Errorf("Request body = %q, want %q", e.Request.Body, message)
+		}
+	}
+}
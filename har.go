@@ -0,0 +1,249 @@
+package recorder
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// harLog is the root of a HAR (HTTP Archive) 1.2 file, as described in
+// http://www.softwareishard.com/blog/har-12-spec/.
+type harLog struct {
+	Log struct {
+		Version string     `json:"version"`
+		Creator harCreator `json:"creator"`
+		Entries []harEntry `json:"entries"`
+	} `json:"log"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	Comment         string      `json:"comment,omitempty"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type harContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// WriteHAR writes the recorded entries to w in the HAR (HTTP Archive) 1.2
+// format. The output can be loaded in browser developer tools and other HAR
+// viewers.
+//
+// The recorder does not save the protocol version or timing details of
+// requests, so all entries use HTTP/1.1 and the duration of each entry is
+// reported as waiting time. Entries that failed with an error have a status
+// of 0 and the error as a comment. Response bodies that are not valid UTF-8
+// are base64 encoded.
+func (r *Recorder) WriteHAR(w io.Writer) error {
+	var har harLog
+	har.Log.Version = "1.2"
+	har.Log.Creator = harCreator{Name: "github.com/akupila/recorder"}
+	har.Log.Entries = []harEntry{}
+	for _, e := range r.Entries() {
+		har.Log.Entries = append(har.Log.Entries, newHAREntry(e))
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(har)
+}
+
+func newHAREntry(e Entry) harEntry {
+	ms := float64(e.Duration) / float64(time.Millisecond)
+	he := harEntry{
+		StartedDateTime: e.Timestamp,
+		Time:            ms,
+		Timings:         harTimings{Wait: ms},
+		Comment:         e.Error,
+		Request: harRequest{
+			Method:      e.Request.Method,
+			URL:         e.Request.URL,
+			HTTPVersion: "HTTP/1.1",
+			Cookies:     []harNameValue{},
+			Headers:     harHeaders(e.Request.Headers),
+			QueryString: []harNameValue{},
+			HeadersSize: -1,
+			BodySize:    len(e.Request.Body),
+		},
+		Response: harResponse{
+			HTTPVersion: "HTTP/1.1",
+			Cookies:     []harNameValue{},
+			Headers:     []harNameValue{},
+			HeadersSize: -1,
+		},
+	}
+	if u, err := url.Parse(e.Request.URL); err == nil {
+		he.Request.QueryString = harQuery(u.Query())
+	}
+	if e.Request.Body != "" {
+		he.Request.PostData = &harPostData{
+			MimeType: e.Request.Header("Content-Type"),
+			Text:     e.Request.Body,
+		}
+	}
+	if resp := e.Response; resp != nil {
+		he.Response.Status = resp.StatusCode
+		he.Response.StatusText = http.StatusText(resp.StatusCode)
+		he.Response.Headers = harHeaders(resp.Headers)
+		he.Response.RedirectURL = resp.Header("Location")
+		he.Response.BodySize = len(resp.Body)
+		he.Response.Content = harContent{
+			Size:     len(resp.Body),
+			MimeType: resp.Header("Content-Type"),
+			Text:     resp.Body,
+		}
+		if !utf8.ValidString(resp.Body) {
+			he.Response.Content.Text = base64.StdEncoding.EncodeToString([]byte(resp.Body))
+			he.Response.Content.Encoding = "base64"
+		}
+	}
+	return he
+}
+
+// ImportHAR reads a HAR (HTTP Archive) file, such as one exported from
+// browser developer tools, and returns its entries. The entries can be
+// replayed by adding them to a recorder with Add.
+//
+// Only the method, url, headers and body of requests and the status code,
+// headers and body of responses are imported, along with the start time and
+// duration. Headers are flattened to their first value and HTTP/2 pseudo
+// headers such as :authority are skipped. Entries without a response, which
+// have a status of 0, are imported as failed requests.
+func ImportHAR(r io.Reader) ([]Entry, error) {
+	var har harLog
+	if err := json.NewDecoder(r).Decode(&har); err != nil {
+		return nil, fmt.Errorf("decode har: %v", err)
+	}
+	entries := make([]Entry, 0, len(har.Log.Entries))
+	for i, he := range har.Log.Entries {
+		e := Entry{
+			Request: &Request{
+				Method:  he.Request.Method,
+				URL:     he.Request.URL,
+				Headers: flattenHARHeaders(he.Request.Headers),
+			},
+			Timestamp: he.StartedDateTime,
+			Duration:  time.Duration(he.Time * float64(time.Millisecond)).Round(time.Millisecond),
+		}
+		if he.Request.PostData != nil {
+			e.Request.Body = he.Request.PostData.Text
+		}
+		if he.Response.Status == 0 {
+			e.Error = he.Comment
+			if e.Error == "" {
+				e.Error = "no response"
+			}
+			entries = append(entries, e)
+			continue
+		}
+		body := he.Response.Content.Text
+		if he.Response.Content.Encoding == "base64" {
+			b, err := base64.StdEncoding.DecodeString(body)
+			if err != nil {
+				return nil, fmt.Errorf("decode body of entry %d: %v", i, err)
+			}
+			body = string(b)
+		}
+		e.Response = &Response{
+			StatusCode: he.Response.Status,
+			Headers:    flattenHARHeaders(he.Response.Headers),
+			Body:       body,
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+func flattenHARHeaders(in []harNameValue) map[string]string {
+	out := make(map[string]string, len(in))
+	for _, h := range in {
+		if strings.HasPrefix(h.Name, ":") {
+			continue
+		}
+		k := textproto.CanonicalMIMEHeaderKey(h.Name)
+		if _, ok := out[k]; !ok {
+			out[k] = h.Value
+		}
+	}
+	return out
+}
+
+func harHeaders(headers map[string]string) []harNameValue {
+	out := make([]harNameValue, 0, len(headers))
+	for k, v := range headers {
+		out = append(out, harNameValue{Name: k, Value: v})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+func harQuery(values url.Values) []harNameValue {
+	out := []harNameValue{}
+	for k, vv := range values {
+		for _, v := range vv {
+			out = append(out, harNameValue{Name: k, Value: v})
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
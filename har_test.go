@@ -0,0 +1,219 @@
+package recorder_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/akupila/recorder"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestWriteHAR(t *testing.T) {
+	removeRecording(t, "testdata/har")
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"ok":true}`))
+	}))
+	defer ts.Close()
+
+	rec := recorder.New("testdata/har")
+	cli := &http.Client{Transport: rec}
+	resp, err := cli.Post(ts.URL+"/users?b=2&a=1", "application/json", strings.NewReader(`{"name":"test"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	var buf bytes.Buffer
+	if err := rec.WriteHAR(&buf); err != nil {
+		t.Fatalf("WriteHAR: %v", err)
+	}
+
+	type nameValue struct{ Name, Value string }
+	var har struct {
+		Log struct {
+			Version string
+			Entries []struct {
+				StartedDateTime time.Time
+				Time            float64
+				Request         struct {
+					Method      string
+					URL         string
+					Headers     []nameValue
+					QueryString []nameValue
+					PostData    struct{ MimeType, Text string }
+				}
+				Response struct {
+					Status     int
+					StatusText string
+					Content    struct {
+						Size     int
+						MimeType string
+						Text     string
+					}
+				}
+			}
+		}
+	}
+	if err := json.Unmarshal(buf.Bytes(), &har); err != nil {
+		t.Fatalf("Unmarshal HAR: %v\n%s", err, buf.String())
+	}
+	if har.Log.Version != "1.2" {
+		t.Errorf("Version = %q, want %q", har.Log.Version, "1.2")
+	}
+	if len(har.Log.Entries) != 1 {
+		t.Fatalf("Got %d entries, want 1", len(har.Log.Entries))
+	}
+
+	e := har.Log.Entries[0]
+	if e.StartedDateTime.IsZero() {
+		t.Error("StartedDateTime is not set")
+	}
+	if e.Request.Method != "POST" || e.Request.URL != ts.URL+"/users?a=1&b=2" {
+		t.Errorf("Request = %s %s, want POST %s", e.Request.Method, e.Request.URL, ts.URL+"/users?a=1&b=2")
+	}
+	if diff := cmp.Diff(e.Request.QueryString, []nameValue{{"a", "1"}, {"b", "2"}}); diff != "" {
+		t.Errorf("Query string does not match (-got, +want)\n%s", diff)
+	}
+	if e.Request.PostData.MimeType != "application/json" || e.Request.PostData.Text != `{"name":"test"}` {
+		t.Errorf("Post data = %+v", e.Request.PostData)
+	}
+	if e.Response.Status != 201 || e.Response.StatusText != "Created" {
+		t.Errorf("Status = %d %s, want 201 Created", e.Response.Status, e.Response.StatusText)
+	}
+	if e.Response.Content.Text != `{"ok":true}` || e.Response.Content.Size != 11 || e.Response.Content.MimeType != "application/json" {
+		t.Errorf("Content = %+v", e.Response.Content)
+	}
+}
+
+const harFile = `{
+  "log": {
+    "version": "1.2",
+    "creator": {"name": "WebInspector", "version": "537.36"},
+    "entries": [
+      {
+        "startedDateTime": "2019-05-02T10:00:00.123Z",
+        "time": 42.4,
+        "request": {
+          "method": "GET",
+          "url": "https://example.com/users/1",
+          "httpVersion": "http/2.0",
+          "headers": [
+            {"name": ":authority", "value": "example.com"},
+            {"name": "accept", "value": "application/json"}
+          ],
+          "queryString": [],
+          "cookies": [],
+          "headersSize": -1,
+          "bodySize": 0
+        },
+        "response": {
+          "status": 200,
+          "statusText": "",
+          "httpVersion": "http/2.0",
+          "headers": [
+            {"name": "content-type", "value": "application/json"}
+          ],
+          "cookies": [],
+          "content": {"size": 8, "mimeType": "application/json", "text": "eyJpZCI6MX0=", "encoding": "base64"},
+          "redirectURL": "",
+          "headersSize": -1,
+          "bodySize": -1
+        },
+        "cache": {},
+        "timings": {"send": 0, "wait": 42.4, "receive": 0}
+      },
+      {
+        "startedDateTime": "2019-05-02T10:00:01Z",
+        "time": 0,
+        "request": {
+          "method": "POST",
+          "url": "https://example.com/users",
+          "httpVersion": "http/2.0",
+          "headers": [],
+          "queryString": [],
+          "cookies": [],
+          "postData": {"mimeType": "application/json", "text": "{\"name\":\"test\"}"},
+          "headersSize": -1,
+          "bodySize": 15
+        },
+        "response": {
+          "status": 0,
+          "statusText": "",
+          "httpVersion": "",
+          "headers": [],
+          "cookies": [],
+          "content": {"size": 0, "mimeType": "x-unknown"},
+          "redirectURL": "",
+          "headersSize": -1,
+          "bodySize": -1
+        },
+        "cache": {},
+        "timings": {"send": 0, "wait": 0, "receive": 0}
+      }
+    ]
+  }
+}`
+
+func TestImportHAR(t *testing.T) {
+	entries, err := recorder.ImportHAR(strings.NewReader(harFile))
+	if err != nil {
+		t.Fatalf("ImportHAR: %v", err)
+	}
+	want := []recorder.Entry{
+		{
+			Request: &recorder.Request{
+				Method:  "GET",
+				URL:     "https://example.com/users/1",
+				Headers: map[string]string{"Accept": "application/json"},
+			},
+			Response: &recorder.Response{
+				StatusCode: 200,
+				Headers:    map[string]string{"Content-Type": "application/json"},
+				Body:       `{"id":1}`,
+			},
+			Timestamp: time.Date(2019, 5, 2, 10, 0, 0, 123e6, time.UTC),
+			Duration:  42 * time.Millisecond,
+		},
+		{
+			Request: &recorder.Request{
+				Method:  "POST",
+				URL:     "https://example.com/users",
+				Headers: map[string]string{},
+				Body:    `{"name":"test"}`,
+			},
+			Error:     "no response",
+			Timestamp: time.Date(2019, 5, 2, 10, 0, 1, 0, time.UTC),
+		},
+	}
+	if diff := cmp.Diff(entries, want); diff != "" {
+		t.Errorf("Entries do not match (-got, +want)\n%s", diff)
+	}
+
+	// Imported entries can be replayed from memory
+	rec := &recorder.Recorder{Mode: recorder.ReplayOnly}
+	rec.Add(entries...)
+	resp, err := rec.Client().Get("https://example.com/users/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != `{"id":1}` {
+		t.Errorf("Body = %q, want %q", body, `{"id":1}`)
+	}
+
+	if _, err := recorder.ImportHAR(strings.NewReader("{")); err == nil {
+		t.Error("Expected error for invalid HAR")
+	}
+}
@@ -0,0 +1,105 @@
+package recorder
+
+import (
+	"net/http"
+	"sort"
+)
+
+// A HeaderField is a single header value.
+type HeaderField struct {
+	Name  string `yaml:"name" json:"name"`
+	Value string `yaml:"value" json:"value"`
+}
+
+// HeaderList is a list of header fields. Unlike a map, it keeps repeated
+// values of a header in order. The order of different headers is not
+// preserved, as http.Header doesn't record it; lists created with
+// NewHeaderList are sorted by name.
+type HeaderList []HeaderField
+
+// NewHeaderList returns the headers as a list sorted by name. Repeated values
+// of a header keep their order.
+func NewHeaderList(h http.Header) HeaderList {
+	names := make([]string, 0, len(h))
+	for k := range h {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var l HeaderList
+	for _, k := range names {
+		for _, v := range h[k] {
+			l = append(l, HeaderField{Name: k, Value: v})
+		}
+	}
+	return l
+}
+
+// Header returns the list as an http.Header. The values of each header keep
+// their order in the list.
+func (l HeaderList) Header() http.Header {
+	h := make(http.Header, len(l))
+	for _, f := range l {
+		h.Add(f.Name, f.Value)
+	}
+	return h
+}
+
+// header returns all headers of the request, including repeated values from
+// MultiHeaders.
+func (r *Request) header() http.Header {
+	return withMultiHeaders(r.Headers, r.MultiHeaders)
+}
+
+// header returns all headers of the response, including repeated values from
+// MultiHeaders.
+func (r *Response) header() http.Header {
+	return withMultiHeaders(r.Headers, r.MultiHeaders)
+}
+
+func withMultiHeaders(headers map[string]string, multi map[string][]string) http.Header {
+	h := expandHeader(headers)
+	for k, vv := range multi {
+		if len(vv) == 0 || headers[k] != vv[0] {
+			continue
+		}
+		h.Del(k)
+		for _, v := range vv {
+			h.Add(k, v)
+		}
+	}
+	return h
+}
+
+// withHeaderLists returns a copy of the entry with the headers stored in
+// HeaderList instead of Headers.
+func withHeaderLists(e Entry) Entry {
+	if e.Request != nil {
+		req := *e.Request
+		req.HeaderList = NewHeaderList(req.header())
+		req.Headers, req.MultiHeaders = nil, nil
+		e.Request = &req
+	}
+	if e.Response != nil {
+		resp := *e.Response
+		resp.HeaderList = NewHeaderList(resp.header())
+		resp.Headers, resp.MultiHeaders = nil, nil
+		e.Response = &resp
+	}
+	return e
+}
+
+// fromHeaderLists moves headers stored in HeaderList to Headers.
+func fromHeaderLists(entries []Entry) {
+	for _, e := range entries {
+		if req := e.Request; req != nil && req.HeaderList != nil {
+			h := req.HeaderList.Header()
+			req.Headers, req.MultiHeaders = flattenHeader(h), multiHeaders(h)
+			req.HeaderList = nil
+		}
+		if resp := e.Response; resp != nil && resp.HeaderList != nil {
+			h := resp.HeaderList.Header()
+			resp.Headers, resp.MultiHeaders = flattenHeader(h), multiHeaders(h)
+			resp.HeaderList = nil
+		}
+	}
+}
@@ -2,27 +2,113 @@ package recorder
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math/rand"
+	"mime"
 	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
+	"net/url"
 	"os"
 	"path"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
 
 	"gopkg.in/yaml.v2"
 )
 
+// ErrNoRequest is matched by NoRequestError with errors.Is, which also
+// unwraps the *url.Error returned by http.Client:
+//
+//     if errors.Is(err, recorder.ErrNoRequest) {
+//         // Recorded entry was not found.
+//     }
+var ErrNoRequest = errors.New("no recorded entry")
+
 // NoRequestError is returned when the recorder mode is ReplayOnly and a
 // corresponding entry is not found for the current request.
 //
+// Because the error is returned from the transport, it may be wrapped. Use
+// errors.Is with ErrNoRequest to check for it, or errors.As to access the
+// request.
+type NoRequestError struct {
+	Request *http.Request
+
+	// Reason optionally explains why no entry was selected. It is set by
+	// selectors such as InOrder.
+	Reason string
+}
+
+// Error implements the error interface.
+func (e NoRequestError) Error() string {
+	if e.Reason != "" {
+		return fmt.Sprintf("no recorded entry: %s", e.Reason)
+	}
+	return fmt.Sprintf("no recorded entry")
+}
+
+// Is reports whether target is ErrNoRequest.
+func (e NoRequestError) Is(target error) bool { return target == ErrNoRequest }
+
+// MismatchError is returned when the recorder mode is ReplayOrRecord and
+// entries exist for the method and URL of the request, but none of them match
+// the headers and body of the request.
+//
+// Because the error is returned from the transport, it may be wrapped.
+type MismatchError struct {
+	Request *http.Request
+
+	// Entry is the first recorded entry with the same method and URL.
+	Entry Entry
+}
+
+// Error implements the error interface.
+func (e MismatchError) Error() string {
+	return fmt.Sprintf("request does not match recorded entry for %s %s", e.Entry.Request.Method, e.Entry.Request.URL)
+}
+
+// FilterError is returned when a filter panics, for example by dereferencing
+// the Response of an entry for a request that failed. It identifies the
+// filter that failed and the entry it was applied to.
+//
 // Because the error is returned from the transport, it may be wrapped.
-type NoRequestError struct{ Request *http.Request }
+type FilterError struct {
+	// Index is the index of the filter in Filters, or in RawFilters if Raw
+	// is set.
+	Index int
+	Raw   bool
+
+	// Entry is the entry the filter was applied to, including any changes
+	// made by the filters before it.
+	Entry Entry
+
+	// Panic is the value the filter panicked with.
+	Panic interface{}
+}
 
 // Error implements the error interface.
-func (e NoRequestError) Error() string { return fmt.Sprintf("no recorded entry") }
+func (e FilterError) Error() string {
+	name := "Filters"
+	if e.Raw {
+		name = "RawFilters"
+	}
+	var req string
+	if e.Entry.Request != nil {
+		req = fmt.Sprintf(" for %s %s", e.Entry.Request.Method, e.Entry.Request.URL)
+	}
+	return fmt.Sprintf("%s[%d] panicked%s: %v", name, e.Index, req, e.Panic)
+}
 
 // Mode controls the mode of the recorder.
 type Mode int
@@ -30,7 +116,10 @@ type Mode int
 // Possible values:
 const (
 	// Auto reads requests from disk if a recording exists. If one does not
-	// exist, the request is performed and results saved to disk.
+	// exist, the request is performed and results saved to disk. Once a
+	// request has been recorded, identical requests replay the new entry, so
+	// a request is only sent once per process even if it is repeated in a
+	// loop or sent concurrently.
 	Auto Mode = iota
 
 	// ReplayOnly only allows replaying from disk without network traffic.
@@ -45,281 +134,2263 @@ const (
 	// directly to client. Responses are not recorded to disk but can be
 	// retrieved from the with Lookup().
 	Passthrough
+
+	// Verify performs all requests and compares the responses to previously
+	// recorded entries. OnMismatch is called if a response differs from the
+	// recording. Nothing is saved to disk. If a recorded entry does not
+	// exist, NoRequestError is returned.
+	Verify
+
+	// ReplayOrRecord reads requests from disk if a recording with the same
+	// method, URL, headers and body exists. Requests to a method and URL that
+	// have not been recorded are performed and saved to disk. If the method
+	// and URL have been recorded, but with different headers or body,
+	// MismatchError is returned.
+	ReplayOrRecord
 )
 
-// Selector chooses a recorded Entry to response to a given request.
-type Selector interface {
-	Select(entries []Entry, req *http.Request) (Entry, bool)
+// ModeEnv is the environment variable that overrides the mode of all
+// recorders when set, except ones created with NewReplayOnly. This allows
+// using Auto locally to record new interactions and ReplayOnly in CI without
+// code changes:
+//
+//     RECORDER_MODE=replay go test ./...
+//
+// Valid values are auto, replay, record, passthrough, verify and
+// replay-or-record. If the value is invalid, requests and saving fail with an
+// error.
+const ModeEnv = "RECORDER_MODE"
+
+var modeNames = map[string]Mode{
+	"auto":             Auto,
+	"replay":           ReplayOnly,
+	"record":           Record,
+	"passthrough":      Passthrough,
+	"verify":           Verify,
+	"replay-or-record": ReplayOrRecord,
+}
+
+// ParseMode returns the mode for the given name, as used in ModeEnv. Names are
+// case insensitive.
+func ParseMode(name string) (Mode, error) {
+	m, ok := modeNames[strings.ToLower(strings.TrimSpace(name))]
+	if !ok {
+		return 0, fmt.Errorf("invalid mode %q: must be one of auto, replay, record, passthrough, verify or replay-or-record", name)
+	}
+	return m, nil
 }
 
+// DefaultTransport is the transport used for real requests by recorders that
+// do not have a Transport set. If nil, http.DefaultTransport is used.
+//
+// Setting it allows configuring all recorders at once, for example to trust
+// the certificate of a TLS test server:
+//
+//     ts := httptest.NewTLSServer(handler)
+//     recorder.DefaultTransport = ts.Client().Transport
+var DefaultTransport http.RoundTripper
+
+// DefaultBodylessMethods are the methods that have no meaningful request body,
+// for use with Recorder.BodylessMethods.
+var DefaultBodylessMethods = []string{http.MethodGet, http.MethodHead, http.MethodDelete}
+
 // New is a convenience function for creating a new recorder.
 func New(filename string, filters ...Filter) *Recorder {
 	return &Recorder{
-		Filename:  filename,
-		Mode:      Auto,
-		Transport: http.DefaultTransport,
-		Filters:   filters,
+		Filename: filename,
+		Mode:     Auto,
+		Filters:  filters,
 	}
 }
 
+// NewReplayOnly creates a new recorder in ReplayOnly mode that replays the
+// given entries. Nothing is loaded from or saved to disk, and ModeEnv is
+// ignored, so the recorder never sends requests to the network.
+func NewReplayOnly(entries ...Entry) *Recorder {
+	r := &Recorder{Mode: ReplayOnly, ignoreModeEnv: true}
+	r.Add(entries...)
+	return r
+}
+
 // Recorder wraps a http.RoundTripper by recording requests that go through it.
 //
-// When recording, any observed requests are written to disk after response. In
-// case previous entries were recorded for the same endpoint, the file is
-// overwritten on first request.
+// When recording, any observed requests are written to disk after response.
+// The file is rewritten to contain all entries, including ones previously
+// loaded from disk. In Record mode, previously recorded entries are discarded
+// on the first request.
+//
+// Protocol upgrades, such as WebSocket handshakes, are recorded up to the 101
+// Switching Protocols response. When recording, the body of the returned
+// response is the upgraded connection as usual, but traffic sent over it is not
+// recorded. Replayed 101 responses have no body.
+//
+// Requests may be sent concurrently, and the methods that read or modify the
+// entries, such as Lookup, Add and Save, may be called while requests are in
+// flight. The fields must not be modified after the first request.
 type Recorder struct {
-	// Filename to use for saved entries. A .yml extension is added if not set.
+	// Filename to use for saved entries. A .yml extension is added if the
+	// filename has no extension. Other extensions, such as .yaml, are kept.
 	// Any subdirectories are created if needed.
 	//
-	// Required if mode is not Passthrough.
+	// Older versions added .yml to all names without it, such as
+	// testdata/api.github.com. If only a file with .yml added exists, it is
+	// used instead.
+	//
+	// If empty, entries are only kept in memory and nothing is loaded from or
+	// saved to disk. Entries can be added with Add.
 	Filename string
 
-	// Mode to use. Default mode is Auto.
+	// Mode to use. Default mode is Auto. If ModeEnv is set, it overrides
+	// the mode when the recorder is first used.
 	Mode Mode
 
+	// Compress gzip-compresses the saved file and adds a .gz extension to
+	// the filename. Filenames that already end in .gz are always compressed.
+	Compress bool
+
+	// FileMode is the permission used for saved files. Defaults to 0644.
+	FileMode os.FileMode
+
+	// DirMode is the permission used for created directories. Defaults to
+	// 0750.
+	DirMode os.FileMode
+
+	// Codec to use for the saved file. If nil, YAMLCodec is used.
+	Codec Codec
+
+	// PrettyJSON saves JSON request and response bodies indented, which makes
+	// the saved file readable and diff friendly. The bodies are compacted
+	// again when loaded, so the replayed bytes are unchanged. Only compact
+	// bodies, optionally followed by a newline, are indented. Bodies are
+	// identified as JSON by their Content-Type.
+	PrettyJSON bool
+
+	// GRPCWebFrames saves binary gRPC-Web bodies, identified by a
+	// Content-Type of application/grpc-web or application/grpc-web+proto,
+	// split into their length-prefixed frames in Frames. Each frame is saved
+	// with its flag byte and base64 encoded data, which makes the structure
+	// of the body inspectable. The frames are joined again when loaded, so
+	// the replayed bytes are unchanged. Bodies that are not complete frames
+	// are saved as is.
+	GRPCWebFrames bool
+
+	// OrderedHeaders saves headers as a list of name and value pairs instead
+	// of a map, in HeaderList. Repeated headers are saved as separate fields
+	// in the order they were sent or received.
+	//
+	// The order of different headers is not preserved: net/http parses
+	// received headers into a map and writes sent headers sorted by name, so
+	// the original order is not available. Headers are sorted by name in the
+	// list. Files saved with ordered headers can be loaded without setting
+	// the option.
+	OrderedHeaders bool
+
 	// Filters to apply before saving to disk.
 	// Filters are executed in the order specified.
+	//
+	// Filters are also applied to the URL and headers of incoming requests
+	// before they are matched against recorded entries, so filters that
+	// change them, such as RemoveQueryParam and RedactBasicAuth, don't
+	// prevent replaying. The entry they receive then only contains the
+	// request method, URL and headers.
 	Filters []Filter
 
+	// RawFilters are applied after Filters. They also receive the original
+	// request and response, for filtering based on information that is not
+	// in the entry.
+	RawFilters []RawFilter
+
+	// An optional Skip function may be specified to exclude entries from the
+	// recording. It is called after filters have been applied. If it returns
+	// true, the entry is neither saved to disk nor kept in memory, but the
+	// response is still returned to the caller.
+	Skip func(entry *Entry) bool
+
+	// An optional ShouldRecord function may be specified to only record
+	// entries it returns true for. It is called after filters have been
+	// applied and is the inverse of Skip, which reads better when keying on
+	// attributes of the response. For example, to not record responses that
+	// must not be cached:
+	//
+	//     rec.ShouldRecord = func(e *recorder.Entry) bool {
+	//         return e.Response == nil || !strings.Contains(e.Response.Header("Cache-Control"), "no-store")
+	//     }
+	ShouldRecord func(entry *Entry) bool
+
+	// An optional RecordOnlyStatus function may be specified to only record
+	// responses with certain status codes. If it returns false, the response
+	// is returned to the caller but it is neither saved to disk nor kept in
+	// memory. This prevents recording failures caused by a misconfigured test
+	// environment, for example:
+	//
+	//     rec.RecordOnlyStatus = func(code int) bool { return code < 400 }
+	RecordOnlyStatus func(code int) bool
+
+	// An optional RecordSampler function may be specified to only record some
+	// of repeated requests. It is called with the method and URL of each
+	// request that would be recorded, and the number of times a request with
+	// the same method and URL has been sent, starting from 1. If it returns
+	// false, the response is returned to the caller but not recorded. This
+	// keeps recordings of clients that poll small, for example by recording
+	// the first and every tenth request:
+	//
+	//     rec.RecordSampler = func(method, url string, occurrence int) bool {
+	//         return occurrence == 1 || occurrence%10 == 0
+	//     }
+	RecordSampler func(method, url string, occurrence int) bool
+
+	// OnMismatch is called in Verify mode when the status code or body of a
+	// response differs from the recorded entry. Filters have been applied to
+	// the live entry before comparing.
+	OnMismatch func(recorded, live Entry)
+
+	// DryRun performs requests and applies filters as usual but never writes
+	// the file. Recorded entries are still kept in memory and can be
+	// inspected with Entries, or with OnWrite to see the serialized file
+	// contents. This is useful to check that filters remove all secrets
+	// before a recording is committed.
+	DryRun bool
+
+	// BodyFileThreshold stores response bodies larger than this many bytes
+	// in separate files next to the recording instead of inline. The files
+	// are named after the recording and the index of the entry, such as
+	// api.0.body for testdata/api.yml. This keeps recordings of large
+	// responses readable and their diffs small. Files that are no longer
+	// referenced are removed when the recording is written. Zero, the
+	// default, stores all bodies inline.
+	BodyFileThreshold int
+
+	// Writer, if set, is written to instead of the file. As a writer cannot
+	// be rewritten, the entries are written when the recorder is closed or
+	// Save is called, and only entries added since the last write are written
+	// again, after a separator. This requires a codec that supports appending,
+	// such as YAMLCodec or JSONLCodec. Changes to entries that were already
+	// written are not written. Existing entries are still loaded from
+	// Filename if it is set; use LoadFrom and Add to load them from elsewhere:
+	//
+	//     var buf bytes.Buffer
+	//     rec := &recorder.Recorder{Mode: recorder.Record, Writer: &buf}
+	//     // ...
+	//     err := rec.Close()
+	Writer io.Writer
+
+	// OnWrite is called with the encoded contents of the file each time it
+	// is written, or would be written in DryRun mode. The data is compressed
+	// if Compress is set.
+	OnWrite func(data []byte)
+
+	// RecordOnce only sends the first of identical requests in Record mode.
+	// Once an entry has been recorded, subsequent matching requests are
+	// replayed from it. Previously recorded entries are never replayed.
+	RecordOnce bool
+
+	// RecordVariants keeps previously recorded entries in Record mode instead
+	// of replacing them, and only adds an entry if no entry with the same
+	// method and URL has the same status, body and error. This allows
+	// recording a sample of the responses of endpoints that intentionally
+	// return different responses, such as randomized or A/B tested ones, by
+	// recording several times. Use RandomAmongMatches or RoundRobin to replay
+	// the variants.
+	RecordVariants bool
+
+	// RecordErrors records requests that fail with a transport error, such as
+	// a refused connection. The error is returned again when the entry is
+	// replayed. By default failed requests are not recorded.
+	RecordErrors bool
+
+	// StreamBody records response bodies as the chunks they were received in,
+	// along with the delay between chunks. When replaying, the chunks are
+	// returned with the same delays. This allows testing consumers of
+	// streaming responses, such as server-sent events. The whole body is
+	// still read before the response is returned when recording.
+	StreamBody bool
+
+	// MaxRequestBodyBytes limits how much of a request body is recorded. If
+	// set, the request body is streamed to the transport and only the first
+	// MaxRequestBodyBytes bytes are recorded. By default the entire body is
+	// read into memory before the request is sent.
+	MaxRequestBodyBytes int
+
+	// BodylessMethods lists methods whose request bodies are neither recorded
+	// nor compared when matching, as a body has no meaning for them. The body
+	// is still sent to the transport. This keeps recordings clean of bodies
+	// that some clients attach to GET requests:
+	//
+	//     rec.BodylessMethods = recorder.DefaultBodylessMethods
+	//
+	// By default bodies are recorded for all methods.
+	BodylessMethods []string
+
+	// Timeout limits the time real requests may take, including reading the
+	// response body. If a request times out, context.DeadlineExceeded is
+	// returned and nothing is recorded, even if RecordErrors is set. This
+	// prevents slow servers from stalling tests when recording. Replayed
+	// requests are not affected. By default there is no timeout.
+	Timeout time.Duration
+
+	// Now returns the current time. It is used for the timestamp and duration
+	// of entries and the delays between streamed chunks. If nil, time.Now is
+	// used. Setting a fixed clock makes the saved file deterministic.
+	Now func() time.Time
+
 	// Transport to use for real request.
-	// If nil, http.DefaultTransport is used.
+	// If nil, DefaultTransport is used.
+	//
+	// If the transport sends requests through a proxy, the request is
+	// recorded as sent by the client, before any headers are added by the
+	// proxy. The response is recorded as received, including any headers
+	// added by the proxy such as Via. Replayed responses are not sent through
+	// the proxy.
 	Transport http.RoundTripper
 
+	// CollapseRedirects follows redirects when recording and records the final
+	// response for the original request as a single entry. Intermediate
+	// responses are neither returned nor recorded, so the client does not
+	// see the redirects. When replaying, the final response is returned for
+	// the original URL directly. Redirects are followed like http.Client
+	// does by default, up to 10 times.
+	CollapseRedirects bool
+
+	// RecordHosts limits recording and replaying to requests to the given
+	// hosts. Requests to other hosts are passed directly to the transport, as
+	// in Passthrough mode. If empty, requests to all hosts are recorded.
+	//
+	// PassthroughHosts passes requests to the given hosts directly to the
+	// transport, even if they are in RecordHosts.
+	//
+	// Hosts may be specified with or without a port and are case-insensitive.
+	// This allows tests to use the same client to talk to a recorded third
+	// party API and a local service:
+	//
+	//     rec.PassthroughHosts = []string{"localhost", "127.0.0.1"}
+	RecordHosts      []string
+	PassthroughHosts []string
+
+	// An optional Passthrough function may be specified to pass individual
+	// requests directly to the transport, as in Passthrough mode. Requests it
+	// returns false for are handled according to Mode. For example, to never
+	// replay requests that ask for fresh data:
+	//
+	//     rec.Passthrough = func(req *http.Request) bool {
+	//         return req.Header.Get("Cache-Control") == "no-cache"
+	//     }
+	Passthrough func(req *http.Request) bool
+
 	// An optional Select function may be specified to control which recorded
 	// Entry is selected to respond to a given request. If nil, the default
 	// selection is used that picks the first recorded response with a matching
 	// method and url.
 	Selector Selector
 
-	once    sync.Once
-	index   int
-	entries []Entry
+	// MatchHost requires the Host of the request to match the recorded Host
+	// in the default selection. This is useful when requests to the same URL
+	// are sent with different Host headers.
+	MatchHost bool
+
+	// An optional IgnorePathSegments function may be specified to ignore
+	// segments of the URL path in the default selection. Segments for which
+	// it returns true match any other ignored segment, so requests to REST
+	// APIs with generated ids can be replayed. The recorded URL is saved
+	// unmodified. For example, to ignore UUIDs:
+	//
+	//     uuid := regexp.MustCompile(`^[0-9a-f]{8}-([0-9a-f]{4}-){3}[0-9a-f]{12}$`)
+	//     rec.IgnorePathSegments = uuid.MatchString
+	IgnorePathSegments func(segment string) bool
+
+	// An optional MatchURL function may be specified to transform URLs before
+	// they are compared in the default selection and in ReplayOrRecord mode.
+	// It is called with both the incoming request and each recorded request,
+	// which has no body. The recorded URL is saved unmodified, unlike with a
+	// filter. For example, to ignore a volatile token in the query:
+	//
+	//     rec.MatchURL = func(req *http.Request) string {
+	//         u := *req.URL
+	//         q := u.Query()
+	//         q.Del("token")
+	//         u.RawQuery = q.Encode()
+	//         return u.String()
+	//     }
+	//
+	// MatchURL is not used if a Selector is set.
+	MatchURL func(req *http.Request) string
+
+	// MethodOverrideHeader is the name of a header used to tunnel methods
+	// through POST, such as X-HTTP-Method-Override. If set, the value of the
+	// header is used instead of the method of the request in the default
+	// selection, so a POST with the header set to DELETE only matches entries
+	// recorded as DELETE, or recorded with the same header. Entries are
+	// recorded with the method that was sent and the header.
+	MethodOverrideHeader string
+
+	// An optional BodyMatcher may be specified to also compare request
+	// bodies in the default selection. If nil, bodies are not compared.
+	BodyMatcher BodyMatcher
+
+	// IgnoreHeaders lists request headers that are not compared when matching
+	// headers in ReplayOrRecord mode. The names are case-insensitive. The
+	// headers are still recorded, unless removed with a filter. This prevents
+	// headers that depend on the environment from causing mismatches, such as
+	// the default User-Agent that includes the Go version:
+	//
+	//     rec.IgnoreHeaders = []string{"User-Agent", "Accept-Encoding"}
+	IgnoreHeaders []string
+
+	once        sync.Once
+	entriesMu   sync.RWMutex
+	flightMu    sync.Mutex
+	flights     map[string]chan struct{}
+	overwritten bool
+	dirty       bool
+	entries     []Entry
+	rerecord    []Request
+	written     int
+
+	// ignoreModeEnv is set by NewReplayOnly
+	ignoreModeEnv bool
+	// modeErr is set if ModeEnv has an invalid value
+	modeErr error
+
+	countMu     sync.Mutex
+	replayed    int
+	network     int
+	reqBytes    int64
+	respBytes   int64
+	observed    []Request
+	occurrences map[string]int
 }
 
 var _ http.RoundTripper = (*Recorder)(nil)
 
-func (r *Recorder) loadFromDisk() {
-	if r.Mode == Passthrough {
-		return
-	}
-	if !strings.HasSuffix(r.Filename, ".yml") {
-		r.Filename += ".yml"
+func (r *Recorder) countNetwork() {
+	r.countMu.Lock()
+	r.network++
+	r.countMu.Unlock()
+}
+
+// ReplayCount returns the number of responses that have been replayed from
+// recorded entries.
+func (r *Recorder) ReplayCount() int {
+	r.countMu.Lock()
+	defer r.countMu.Unlock()
+	return r.replayed
+}
+
+// NetworkCount returns the number of requests that have been sent to the
+// transport. This allows asserting that tests run without network traffic:
+//
+//     if n := rec.NetworkCount(); n > 0 {
+//         t.Errorf("Sent %d requests over the network", n)
+//     }
+func (r *Recorder) NetworkCount() int {
+	r.countMu.Lock()
+	defer r.countMu.Unlock()
+	return r.network
+}
+
+// countBytes adds the size of the bodies of the entry to the byte counters.
+func (r *Recorder) countBytes(e Entry) {
+	r.countMu.Lock()
+	defer r.countMu.Unlock()
+	if e.Request != nil {
+		r.reqBytes += int64(len(e.Request.Body))
 	}
-	existing, err := ioutil.ReadFile(r.Filename)
-	if err == nil {
-		values := bytes.Split(existing, []byte("\n---\n"))
-		for i, val := range values {
-			if len(val) == 0 {
-				continue
-			}
-			var e Entry
-			if err := yaml.Unmarshal(val, &e); err != nil {
-				panic(fmt.Sprintf("unmarshal session %d from %s: %v", i, r.Filename, err))
-			}
-			r.entries = append(r.entries, e)
-		}
+	if e.Response != nil {
+		r.respBytes += int64(len(e.Response.Body))
 	}
 }
 
-// RoundTrip implements http.RoundTripper and does the actual request.
-//
-// The behavior depends on the mode set:
+// RequestBytes returns the total size of the request bodies that have been
+// replayed or recorded. Requests that are passed to the transport without
+// recording are not counted.
+func (r *Recorder) RequestBytes() int64 {
+	r.countMu.Lock()
+	defer r.countMu.Unlock()
+	return r.reqBytes
+}
+
+// ResponseBytes returns the total size of the response bodies that have been
+// replayed or recorded. This allows asserting how much a client downloads,
+// regardless of whether the responses were replayed:
 //
-//     Auto:          If an existing entry exists, the response from the entry
-//                    is returned.
-//     ReplayOnly:    Returns a previously recorded response. Returns
-//                    NoRequestError if an entry is found for the request.
-//     Record:        Always send real request and record the response. If an
-//                    existing entry is found, it is overwritten.
-//     Passthrough:   The request is passed through to the underlying
-//                    transport.
+//     if n := rec.ResponseBytes(); n > 1<<20 {
+//         t.Errorf("Downloaded %d bytes, want at most 1 MiB", n)
+//     }
 //
-// Attempting to set another mode will cause a panic.
-func (r *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
-	if r.Mode > Passthrough {
-		panic("Unsupported mode")
+// Responses that are passed through without recording are not counted.
+func (r *Recorder) ResponseBytes() int64 {
+	r.countMu.Lock()
+	defer r.countMu.Unlock()
+	return r.respBytes
+}
+
+// observe adds the request to the observed requests. The body is only read if
+// withBody is set.
+func (r *Recorder) observe(req *http.Request, withBody bool) {
+	o := Request{
+		Method:  req.Method,
+		URL:     canonicalURL(req.URL.String()),
+		Headers: flattenHeader(req.Header),
 	}
+	if withBody && !r.bodyless(req.Method) {
+		o.Body = string(readBody(req))
+	}
+	r.countMu.Lock()
+	r.observed = append(r.observed, o)
+	r.countMu.Unlock()
+}
 
-	r.once.Do(r.loadFromDisk)
+// ObservedRequests returns all requests sent through the recorder in the order
+// they were sent, whether they were replayed or sent to the transport. The
+// bodies of requests passed directly to the transport, or streamed because of
+// MaxRequestBodyBytes, are not included.
+//
+// The requests are kept in memory until ResetObservedRequests is called.
+// Recorders that are used for many requests, such as one shared by all tests
+// in a package, should reset them once they have been checked.
+func (r *Recorder) ObservedRequests() []Request {
+	r.countMu.Lock()
+	defer r.countMu.Unlock()
+	return append([]Request(nil), r.observed...)
+}
 
-	if r.Mode == Auto || r.Mode == ReplayOnly {
-		var e Entry
-		var ok bool
-		if r.Selector != nil {
-			e, ok = r.Selector.Select(r.entries, req)
-		} else {
-			e, ok = r.Lookup(req.Method, req.URL.String())
+// ResetObservedRequests forgets the observed requests, so ObservedRequests and
+// VerifyRequests only consider requests sent after it. This allows verifying
+// the requests of each test separately with a shared recorder:
+//
+//     rec.ResetObservedRequests()
+//     // ...
+//     err := rec.VerifyRequests(want...)
+func (r *Recorder) ResetObservedRequests() {
+	r.countMu.Lock()
+	r.observed = nil
+	r.countMu.Unlock()
+}
+
+// VerifyRequests compares the observed requests to the expected ones, and
+// returns an error describing the first difference. Requests are compared by
+// method and URL, and by body if the expected body is not empty. This allows
+// asserting that a client sent exactly the expected requests:
+//
+//     err := rec.VerifyRequests(
+//         recorder.Request{Method: "POST", URL: "https://api.example.com/login"},
+//         recorder.Request{Method: "GET", URL: "https://api.example.com/items"},
+//     )
+//     if err != nil {
+//         t.Error(err)
+//     }
+func (r *Recorder) VerifyRequests(want ...Request) error {
+	got := r.ObservedRequests()
+	for i, w := range want {
+		if i >= len(got) {
+			return fmt.Errorf("missing request %d: %s %s", i, w.Method, w.URL)
 		}
-		if ok {
-			resp := e.Response
-			return &http.Response{
-				StatusCode:    resp.StatusCode,
-				Header:        expandHeader(resp.Headers),
-				Body:          ioutil.NopCloser(strings.NewReader(resp.Body)),
-				ContentLength: int64(len(e.Response.Body)),
-			}, nil
+		g := got[i]
+		if !strings.EqualFold(g.Method, w.Method) || !equalURL(g.URL, w.URL) {
+			return fmt.Errorf("request %d is %s %s, want %s %s", i, g.Method, g.URL, w.Method, w.URL)
 		}
-		if r.Mode == ReplayOnly {
-			return nil, NoRequestError{Request: req}
+		if w.Body != "" && g.Body != w.Body {
+			return fmt.Errorf("request %d %s %s has body %q, want %q", i, g.Method, g.URL, g.Body, w.Body)
 		}
 	}
+	if len(got) > len(want) {
+		g := got[len(want)]
+		return fmt.Errorf("unexpected request %d: %s %s", len(want), g.Method, g.URL)
+	}
+	return nil
+}
 
-	if r.Transport == nil {
-		r.Transport = http.DefaultTransport
+// send sends the request to the transport. If CollapseRedirects is set,
+// redirects are followed.
+func (r *Recorder) send(req *http.Request) (*http.Response, error) {
+	if !r.CollapseRedirects {
+		return r.transport().RoundTrip(req)
+	}
+	cli := &http.Client{Transport: r.transport()}
+	resp, err := cli.Do(req)
+	if uerr, ok := err.(*url.Error); ok {
+		// The caller wraps the error again
+		err = uerr.Err
 	}
+	return resp, err
+}
 
-	// Construct request
-	var bodyOut bytes.Buffer
-	if req.Body != nil {
-		if _, err := io.Copy(&bodyOut, req.Body); err != nil {
-			return nil, err
+// Validate checks the configuration of the recorder and returns an error
+// describing the first problem found. Otherwise some misconfigurations only
+// surface when the first request is sent, as a panic or a confusing error.
+// Call it after configuring the recorder:
+//
+//     rec := recorder.New("testdata/api")
+//     if err := rec.Validate(); err != nil {
+//         t.Fatal(err)
+//     }
+//
+// An empty Filename is valid; the entries are then only kept in memory.
+func (r *Recorder) Validate() error {
+	if r.Mode < Auto || r.Mode > ReplayOrRecord {
+		return fmt.Errorf("unsupported mode %d", r.Mode)
+	}
+	if v := os.Getenv(ModeEnv); v != "" && !r.ignoreModeEnv {
+		if _, err := ParseMode(v); err != nil {
+			return fmt.Errorf("%s: %v", ModeEnv, err)
 		}
 	}
-	req.Body = ioutil.NopCloser(&bodyOut)
-	out := &Request{
-		Method:  req.Method,
-		URL:     req.URL.String(),
-		Headers: flattenHeader(req.Header),
-		Body:    bodyOut.String(),
+	if r.BodyFileThreshold < 0 {
+		return fmt.Errorf("negative BodyFileThreshold %d", r.BodyFileThreshold)
 	}
-	for k, vv := range req.Header {
-		out.Headers[k] = vv[0]
+	if r.BodyFileThreshold > 0 && (r.Filename == "" || r.Writer != nil) {
+		return errors.New("BodyFileThreshold requires a Filename to save body files next to")
 	}
-
-	// Send request
-	start := time.Now()
-	resp, err := r.Transport.RoundTrip(req)
-	if err != nil {
-		return nil, err
+	if r.MaxRequestBodyBytes < 0 {
+		return fmt.Errorf("negative MaxRequestBodyBytes %d", r.MaxRequestBodyBytes)
 	}
-	dur := time.Since(start)
-
-	// Construct response
-	in := &Response{
-		StatusCode: resp.StatusCode,
-		Headers:    flattenHeader(resp.Header),
+	if r.Timeout < 0 {
+		return fmt.Errorf("negative Timeout %s", r.Timeout)
 	}
-	bodyIn, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
+	return nil
+}
+
+// bodyless reports whether request bodies are ignored for the method according
+// to BodylessMethods.
+func (r *Recorder) bodyless(method string) bool {
+	return containsFold(r.BodylessMethods, method)
+}
+
+// passthrough reports whether the request is passed directly to the
+// transport according to Passthrough, RecordHosts and PassthroughHosts.
+func (r *Recorder) passthrough(req *http.Request) bool {
+	if r.Passthrough != nil && r.Passthrough(req) {
+		return true
 	}
-	if err := resp.Body.Close(); err != nil {
-		return nil, err
+	return r.passthroughHost(req.URL)
+}
+
+// passthroughHost reports whether requests to the URL are passed directly to
+// the transport according to RecordHosts and PassthroughHosts.
+func (r *Recorder) passthroughHost(u *url.URL) bool {
+	if matchHost(r.PassthroughHosts, u) {
+		return true
 	}
-	in.Body = string(bodyIn)
+	return len(r.RecordHosts) > 0 && !matchHost(r.RecordHosts, u)
+}
 
-	// Construct entry
-	e := Entry{Request: out, Response: in}
+func matchHost(hosts []string, u *url.URL) bool {
+	for _, h := range hosts {
+		if strings.EqualFold(h, u.Host) || strings.EqualFold(h, u.Hostname()) {
+			return true
+		}
+	}
+	return false
+}
 
-	// Apply filters
-	for _, apply := range r.Filters {
-		apply(&e)
+// codec returns the codec to use for saved files.
+func (r *Recorder) codec() Codec {
+	if r.Codec != nil {
+		return r.Codec
 	}
+	return YAMLCodec{}
+}
 
-	// Reconstruct response after filters have been processed
-	resp = &http.Response{
-		StatusCode:    in.StatusCode,
-		Header:        expandHeader(in.Headers),
-		Body:          ioutil.NopCloser(strings.NewReader(in.Body)),
-		ContentLength: int64(len(in.Body)),
+// transport returns the transport to use for real requests.
+func (r *Recorder) transport() http.RoundTripper {
+	if r.Transport != nil {
+		return r.Transport
 	}
+	if DefaultTransport != nil {
+		return DefaultTransport
+	}
+	return http.DefaultTransport
+}
 
-	// Save entry
-	r.entries = append(r.entries, e)
+func fileExists(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
+}
 
-	if r.Mode == Auto || r.Mode == Record {
-		// Save to disk
-		if err := os.MkdirAll(path.Dir(r.Filename), 0750); err != nil {
-			return nil, err
-		}
+// Client returns a new http.Client that uses the recorder as its transport.
+//
+// The client has no timeout set. The returned client may be modified to set
+// one.
+func (r *Recorder) Client() *http.Client {
+	return &http.Client{Transport: r}
+}
 
-		var filemode int
-		if r.index == 0 {
-			filemode = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
-		} else {
-			filemode = os.O_WRONLY | os.O_APPEND
+func (r *Recorder) loadFromDisk() {
+	if v := os.Getenv(ModeEnv); v != "" && !r.ignoreModeEnv {
+		m, err := ParseMode(v)
+		if err != nil {
+			r.modeErr = fmt.Errorf("%s: %v", ModeEnv, err)
+			return
+		}
+		r.Mode = m
+	}
+	if r.Mode == Passthrough || r.Filename == "" {
+		return
+	}
+	if strings.HasSuffix(r.Filename, ".gz") {
+		r.Compress = true
+	}
+	name := strings.TrimSuffix(r.Filename, ".gz")
+	var gz string
+	if r.Compress {
+		gz = ".gz"
+	}
+	if ext := path.Ext(name); ext == "" {
+		name += ".yml"
+	} else if ext != ".yml" && !fileExists(name+gz) && fileExists(name+".yml"+gz) {
+		// Saved by an older version, which added .yml to all other names
+		name += ".yml"
+	}
+	r.Filename = name + gz
+	existing, err := ioutil.ReadFile(r.Filename)
+	if err == nil && r.Compress && len(existing) > 0 {
+		existing, err = gunzip(existing)
+		if err != nil {
+			panic(fmt.Sprintf("decompress %s: %v", r.Filename, err))
 		}
-		f, err := os.OpenFile(r.Filename, filemode, 0644)
+	}
+	if err == nil {
+		entries, err := r.codec().Decode(bytes.NewReader(existing))
 		if err != nil {
-			return nil, err
+			panic(fmt.Sprintf("%s from %s", err, r.Filename))
 		}
-
-		if r.index > 0 {
-			fmt.Fprintf(f, "\n---\n\n")
+		fromHeaderLists(entries)
+		if err := fromFrames(entries); err != nil {
+			panic(fmt.Sprintf("%s from %s", err, r.Filename))
 		}
-		fmt.Fprintf(f, "# request %d\n", r.index)
-		fmt.Fprintf(f, "# timestamp %s\n", start.UTC().Round(time.Second))
-		fmt.Fprintf(f, "# roundtrip %s\n", dur.Round(time.Millisecond))
-		r.index++
+		if err := loadBodyFiles(r.Filename, entries); err != nil {
+			panic(fmt.Sprintf("%s from %s", err, r.Filename))
+		}
+		if r.PrettyJSON {
+			for i := range entries {
+				compactEntry(&entries[i])
+			}
+		}
+		r.entries = append(r.entries, entries...)
+	}
+}
 
-		b, err := yaml.Marshal(e)
-		if err != nil {
-			return nil, err
+// parseEntries parses entries saved by writeFile.
+func parseEntries(b []byte) ([]Entry, error) {
+	var entries []Entry
+	values := bytes.Split(b, []byte("\n---\n"))
+	for i, val := range values {
+		if len(val) == 0 {
+			continue
 		}
-		if _, err := f.Write(b); err != nil {
-			return nil, err
+		var e Entry
+		if err := yaml.Unmarshal(val, &e); err != nil {
+			return nil, fmt.Errorf("unmarshal session %d: %v", i, err)
 		}
-		if err := f.Close(); err != nil {
-			return nil, err
+		if e.Timestamp.IsZero() && e.Duration == 0 {
+			// Recorded before timing was saved as fields
+			e.Timestamp, e.Duration = parseTiming(val)
 		}
+		entries = append(entries, e)
 	}
+	return entries, nil
+}
 
-	return resp, nil
+// LoadFrom reads entries in the format saved by the recorder from r. This
+// allows defining small recordings inline in tests:
+//
+//     entries, err := recorder.LoadFrom(strings.NewReader(`
+//     request:
+//       method: GET
+//       url: https://example.com
+//     response:
+//       status_code: 200
+//       body: hello
+//     `))
+//     if err != nil {
+//         t.Fatal(err)
+//     }
+//     rec := recorder.NewReplayOnly(entries...)
+func LoadFrom(r io.Reader) ([]Entry, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := parseEntries(b)
+	if err != nil {
+		return nil, err
+	}
+	fromHeaderLists(entries)
+	if err := fromFrames(entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
 }
 
-// Lookup returns an existing entry matching the given method and url.
+// RoundTrip implements http.RoundTripper and does the actual request.
 //
-// The method and url are case-insensitive.
+// The behavior depends on the mode set:
 //
-// Returns false if no such entry exists.
-func (r *Recorder) Lookup(method, url string) (Entry, bool) {
+//     Auto:           If an existing entry exists, the response from the entry
+//                     is returned. Otherwise the request is sent and recorded.
+//                     Identical requests sent while the first one is being
+//                     recorded wait for it and replay its entry.
+//     ReplayOnly:     Returns a previously recorded response. Returns
+//                     NoRequestError if an entry is found for the request.
+//     Record:         Always send real request and record the response. If an
+//                     existing entry is found, it is overwritten.
+//     Passthrough:    The request is passed through to the underlying
+//                     transport.
+//     Verify:         Always send real request and compare the response to
+//                     the recorded entry. Returns NoRequestError if an entry
+//                     is not found for the request.
+//     ReplayOrRecord: If an existing entry exists with the same headers and
+//                     body, the response from the entry is returned. If an
+//                     entry exists with different headers or body, returns
+//                     MismatchError.
+//
+// Attempting to set another mode will cause a panic.
+func (r *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	// The mode may be overridden with ModeEnv when loading
 	r.once.Do(r.loadFromDisk)
-	for _, e := range r.entries {
-		if strings.EqualFold(e.Request.Method, method) && strings.EqualFold(e.Request.URL, url) {
-			return e, true
-		}
+	if r.modeErr != nil {
+		return nil, r.modeErr
+	}
+	if r.Mode > ReplayOrRecord {
+		panic("Unsupported mode")
+	}
+	if req.URL == nil || !req.URL.IsAbs() || req.URL.Host == "" {
+		return nil, fmt.Errorf("invalid request url %q: must be absolute with a scheme and host", req.URL)
 	}
-	return Entry{}, false
-}
 
-// A Filter modifies the entry before it is saved to disk.
-//
-// Filters are applied after the actual request, with the primary purpose
-// being to remove sensitive data from the saved file.
-type Filter func(entry *Entry)
+	skip, _ := req.Context().Value(withoutRecordingKey{}).(bool)
+	pass := skip || r.passthrough(req)
+	r.observe(req, !pass && r.MaxRequestBodyBytes == 0)
+	if pass {
+		r.countNetwork()
+		return r.transport().RoundTrip(req)
+	}
 
-// RemoveRequestHeader removes a header with the given name from the request.
-// The name of the header is case-sensitive.
-func RemoveRequestHeader(name string) Filter {
-	return func(e *Entry) {
-		delete(e.Request.Headers, name)
+	// Entries are matched against the request as it would be recorded
+	match := r.matchRequest(req)
+
+	refresh := -1
+	if r.Mode == Auto || r.Mode == ReplayOrRecord {
+		refresh = r.takeReRecord(match)
 	}
-}
 
-// RemoveResponseHeader removes a header with the given name from the response.
-// The name of the header is case-sensitive.
-func RemoveResponseHeader(name string) Filter {
-	return func(e *Entry) {
-		delete(e.Response.Headers, name)
+	if r.Mode == Auto && refresh < 0 {
+		// Identical requests sent concurrently wait for the first one to be
+		// recorded, so only one of them makes a network call
+		for {
+			r.entriesMu.RLock()
+			e, ok := r.selectEntry(match)
+			r.entriesMu.RUnlock()
+			if ok {
+				return r.replay(req, e)
+			}
+			key := strings.ToUpper(req.Method) + " " + canonicalURL(match.URL.String())
+			wait := r.startFlight(key)
+			if wait == nil {
+				defer r.endFlight(key)
+				break
+			}
+			select {
+			case <-wait:
+			case <-req.Context().Done():
+				return nil, req.Context().Err()
+			}
+		}
 	}
-}
 
-// An Entry is a single recorded request-response entry.
-type Entry struct {
-	Request  *Request  `yaml:"request"`
-	Response *Response `yaml:"response"`
-}
+	var recorded Entry
+	if refresh < 0 && (r.Mode == ReplayOnly || r.Mode == Verify) {
+		var ok bool
+		r.entriesMu.RLock()
+		recorded, ok = r.selectEntry(match)
+		r.entriesMu.RUnlock()
+		if ok && r.Mode != Verify {
+			return r.replay(req, recorded)
+		}
+		if !ok {
+			err := NoRequestError{Request: req}
+			if s, ok := r.Selector.(interface{ reason() string }); ok {
+				err.Reason = s.reason()
+			}
+			return nil, err
+		}
+	}
+
+	if r.Mode == ReplayOrRecord && refresh < 0 {
+		r.entriesMu.RLock()
+		e, ok, err := r.selectExact(match)
+		r.entriesMu.RUnlock()
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return r.replay(req, e)
+		}
+	}
+
+	// Entries recorded in this session may be replayed in Record mode
+	if r.Mode == Record && r.RecordOnce {
+		var e Entry
+		var ok bool
+		r.entriesMu.RLock()
+		if r.overwritten {
+			e, ok = r.selectEntry(match)
+		}
+		r.entriesMu.RUnlock()
+		if ok {
+			return r.replay(req, e)
+		}
+	}
+
+	if match != req {
+		// Reading the body for matching replaces it in the copy
+		req.Body = match.Body
+	}
+
+	// Construct request
+	out := &Request{
+		Method:       req.Method,
+		URL:          canonicalURL(req.URL.String()),
+		Headers:      flattenHeader(req.Header),
+		MultiHeaders: multiHeaders(req.Header),
+	}
+	if req.Host != "" && req.Host != req.URL.Host {
+		out.Host = req.Host
+	}
+	var capture *captureReader
+	switch {
+	case r.bodyless(req.Method):
+		// The body is sent as is, but not recorded
+	case r.MaxRequestBodyBytes > 0 && req.Body != nil:
+		// Stream the body to the transport, only keeping the beginning
+		capture = &captureReader{ReadCloser: req.Body, max: r.MaxRequestBodyBytes}
+		req.Body = capture
+	default:
+		var bodyOut bytes.Buffer
+		if req.Body != nil {
+			if _, err := io.Copy(&bodyOut, req.Body); err != nil {
+				return nil, err
+			}
+		}
+		out.Body = bodyOut.String()
+		req.Body = ioutil.NopCloser(&bodyOut)
+		if r.CollapseRedirects {
+			// Allow the body to be sent again when following redirects
+			b := bodyOut.Bytes()
+			req.GetBody = func() (io.ReadCloser, error) {
+				return ioutil.NopCloser(bytes.NewReader(b)), nil
+			}
+		}
+	}
+	for k, vv := range req.Header {
+		out.Headers[k] = vv[0]
+	}
+
+	// Trace the connection to record the remote address
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			out.RemoteAddr = info.Conn.RemoteAddr().String()
+		},
+	}
+	callerDeadline, hasDeadline := req.Context().Deadline()
+	ctx := httptrace.WithClientTrace(req.Context(), trace)
+	if r.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.Timeout)
+		defer cancel()
+	}
+	req = req.WithContext(ctx)
+
+	// Send request
+	now := r.Now
+	if now == nil {
+		now = time.Now
+	}
+	start := now()
+	var deadline time.Duration
+	if hasDeadline {
+		deadline = callerDeadline.Sub(start).Round(time.Millisecond)
+	}
+	r.countNetwork()
+	resp, rtErr := r.send(req)
+	dur := now().Sub(start)
+	if capture != nil {
+		out.Body = capture.String()
+	}
+
+	// Construct entry
+	e := Entry{
+		Request:   out,
+		Timestamp: start.UTC().Round(time.Millisecond),
+		Duration:  dur.Round(time.Millisecond),
+		Deadline:  deadline,
+	}
+	if rtErr != nil && r.Timeout > 0 && ctx.Err() == context.DeadlineExceeded {
+		// Timed out requests are never recorded
+		return nil, ctx.Err()
+	}
+	if rtErr != nil {
+		if !r.RecordErrors || r.Mode == Verify {
+			return nil, rtErr
+		}
+		e.Error = rtErr.Error()
+	} else {
+		in, err := readResponse(resp, r.StreamBody, now)
+		if err != nil && r.Timeout > 0 && ctx.Err() == context.DeadlineExceeded {
+			return nil, ctx.Err()
+		}
+		if err != nil {
+			return nil, err
+		}
+		e.Response = in
+	}
+	r.countBytes(e)
+
+	if err := r.applyFilters(&e, req, resp); err != nil {
+		return nil, err
+	}
+	e.Request.MultiHeaders = pruneMultiHeaders(e.Request.Headers, e.Request.MultiHeaders)
+	if e.Response != nil {
+		e.Response.MultiHeaders = pruneMultiHeaders(e.Response.Headers, e.Response.MultiHeaders)
+	}
+
+	// Reconstruct response after filters have been processed
+	live := resp
+	resp = nil
+	if e.Response != nil {
+		resp = newResponse(req, e)
+		if live.StatusCode == http.StatusSwitchingProtocols {
+			resp.Body = live.Body
+		}
+	}
+
+	if r.Mode == Verify {
+		if r.OnMismatch != nil && !sameResponse(recorded, e) {
+			r.OnMismatch(recorded, e)
+		}
+		return resp, nil
+	}
+
+	if r.Skip != nil && r.Skip(&e) {
+		return resp, rtErr
+	}
+	if r.ShouldRecord != nil && !r.ShouldRecord(&e) {
+		return resp, rtErr
+	}
+	if r.RecordOnlyStatus != nil && e.Response != nil && !r.RecordOnlyStatus(e.Response.StatusCode) {
+		return resp, rtErr
+	}
+	if r.RecordSampler != nil && !r.RecordSampler(req.Method, req.URL.String(), r.occurrence(req)) {
+		return resp, rtErr
+	}
+
+	r.entriesMu.Lock()
+	defer r.entriesMu.Unlock()
+
+	if r.Mode == Record && r.RecordVariants {
+		for _, existing := range r.entries {
+			if r.matchMethodURL(existing, match) && sameResponse(existing, e) {
+				return resp, rtErr
+			}
+		}
+	}
+
+	// In record mode, previously recorded entries are replaced
+	if r.Mode == Record && !r.overwritten && !r.RecordVariants {
+		r.entries = nil
+		r.overwritten = true
+		r.dirty = true
+	}
+
+	// Save entry
+	if refresh >= len(r.entries) {
+		// Entries were deleted since the mark was taken
+		refresh = -1
+	}
+	if refresh >= 0 {
+		r.entries[refresh] = e
+	} else {
+		r.entries = append(r.entries, e)
+	}
+
+	if r.Mode == Auto || r.Mode == Record || r.Mode == ReplayOrRecord {
+		var err error
+		if refresh >= 0 {
+			err = r.writeFile()
+		} else {
+			err = r.appendFile(e)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return resp, rtErr
+}
+
+// startFlight marks a request that is about to be recorded in Auto mode as in
+// flight. Requests are identical if they have the same method and URL. If an
+// identical request is already in flight, the returned channel is closed when
+// it completes. Otherwise the channel is nil and endFlight must be called once
+// the entry has been saved.
+func (r *Recorder) startFlight(key string) <-chan struct{} {
+	r.flightMu.Lock()
+	defer r.flightMu.Unlock()
+	if ch, ok := r.flights[key]; ok {
+		return ch
+	}
+	if r.flights == nil {
+		r.flights = make(map[string]chan struct{})
+	}
+	r.flights[key] = make(chan struct{})
+	return nil
+}
+
+// endFlight completes a request started with startFlight.
+func (r *Recorder) endFlight(key string) {
+	r.flightMu.Lock()
+	defer r.flightMu.Unlock()
+	close(r.flights[key])
+	delete(r.flights, key)
+}
+
+// matchRequest returns the request to match against recorded entries. If
+// Filters change the URL or header values of the request, the returned
+// request is a shallow copy with the filtered URL and values. Headers removed
+// by filters are kept, as only recorded headers are compared. Otherwise the
+// request is returned as is.
+func (r *Recorder) matchRequest(req *http.Request) *http.Request {
+	if len(r.Filters) == 0 {
+		return req
+	}
+	e := Entry{
+		Request: &Request{
+			Method:  req.Method,
+			URL:     canonicalURL(req.URL.String()),
+			Headers: flattenHeader(req.Header),
+		},
+		Response: &Response{Headers: map[string]string{}},
+	}
+	ok := func() (ok bool) {
+		// Filters that need the full entry are only applied when recording
+		defer func() {
+			if recover() != nil {
+				ok = false
+			}
+		}()
+		for _, apply := range r.Filters {
+			apply(&e)
+		}
+		return true
+	}()
+	if !ok {
+		return req
+	}
+	out := *req
+	if !equalURL(e.Request.URL, req.URL.String()) {
+		u, err := url.Parse(e.Request.URL)
+		if err != nil {
+			return req
+		}
+		out.URL = u
+	}
+	var header http.Header
+	for k, v := range e.Request.Headers {
+		if vv := req.Header[k]; len(vv) > 0 && vv[0] == v {
+			continue
+		}
+		if header == nil {
+			header = req.Header.Clone()
+		}
+		header[k] = []string{v}
+	}
+	if header != nil {
+		out.Header = header
+	}
+	if out.URL == req.URL && header == nil {
+		return req
+	}
+	return &out
+}
+
+// applyFilters applies Filters and RawFilters to the entry. A panic in a
+// filter is returned as a FilterError.
+func (r *Recorder) applyFilters(e *Entry, req *http.Request, resp *http.Response) (err error) {
+	fe := FilterError{Index: -1}
+	defer func() {
+		if v := recover(); v != nil {
+			fe.Entry, fe.Panic = *e, v
+			err = fe
+		}
+	}()
+	for i, apply := range r.Filters {
+		fe.Index = i
+		apply(e)
+	}
+	fe.Raw = true
+	for i, apply := range r.RawFilters {
+		fe.Index = i
+		apply(e, req, resp)
+	}
+	return nil
+}
+
+func readResponse(resp *http.Response, stream bool, now func() time.Time) (*Response, error) {
+	in := &Response{
+		StatusCode: resp.StatusCode,
+		Headers:    flattenHeader(resp.Header),
+		NoBody:     resp.Body == http.NoBody,
+		TLS:        newTLS(resp.TLS),
+	}
+	in.TransferEncoding = resp.TransferEncoding
+	in.MultiHeaders = multiHeaders(resp.Header)
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		// The body is the upgraded connection, which is left to the caller
+		in.NoBody = true
+		return in, nil
+	}
+	if stream {
+		bodyIn, chunks, err := readChunks(resp.Body, now)
+		if err != nil {
+			return nil, err
+		}
+		in.Body = string(bodyIn)
+		in.Chunks = chunks
+	} else {
+		body, err := readResponseBody(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		in.Body = body
+	}
+	if err := resp.Body.Close(); err != nil {
+		return nil, err
+	}
+	return in, nil
+}
+
+// readResponseBody reads the body into a string. HEAD responses are not read,
+// as their Content-Length is that of the resource.
+func readResponseBody(body io.Reader) (string, error) {
+	if body == http.NoBody {
+		return "", nil
+	}
+	b, err := ioutil.ReadAll(body)
+	return string(b), err
+}
+
+// readChunks reads the body, recording each read as a separate chunk along
+// with the time since the previous chunk as reported by now.
+func readChunks(body io.Reader, now func() time.Time) ([]byte, []Chunk, error) {
+	var all []byte
+	var chunks []Chunk
+	buf := make([]byte, 32*1024)
+	last := now()
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			t := now()
+			all = append(all, buf[:n]...)
+			chunks = append(chunks, Chunk{Delay: t.Sub(last), Data: string(buf[:n])})
+			last = t
+		}
+		if err == io.EOF {
+			return all, chunks, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+}
+
+// chunkReader replays chunks, waiting for the recorded delay before each
+// chunk.
+type chunkReader struct {
+	ctx    context.Context
+	chunks []Chunk
+	cur    string
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	for c.cur == "" {
+		if len(c.chunks) == 0 {
+			return 0, io.EOF
+		}
+		next := c.chunks[0]
+		c.chunks = c.chunks[1:]
+		if next.Delay > 0 {
+			t := time.NewTimer(next.Delay)
+			select {
+			case <-t.C:
+			case <-c.ctx.Done():
+				t.Stop()
+				return 0, c.ctx.Err()
+			}
+		}
+		c.cur = next.Data
+	}
+	n := copy(p, c.cur)
+	c.cur = c.cur[n:]
+	return n, nil
+}
+
+func (c *chunkReader) Close() error { return nil }
+
+// Save writes all entries to disk, replacing the existing file. If Writer is
+// set, the entries are written to it instead.
+//
+// Entries are saved automatically after each request in Auto and Record
+// mode. Calling Save is only needed after modifying the entries in some other
+// way.
+func (r *Recorder) Save() error {
+	r.once.Do(r.loadFromDisk)
+	r.entriesMu.Lock()
+	defer r.entriesMu.Unlock()
+	return r.save()
+}
+
+// save writes the entries to Writer or the file. The caller must hold
+// entriesMu.
+func (r *Recorder) save() error {
+	if r.modeErr != nil {
+		return r.modeErr
+	}
+	if r.Writer != nil {
+		return r.writeTo()
+	}
+	return r.writeFile()
+}
+
+// writeFile writes all entries to disk. The file is written to a temporary
+// file first, which is then renamed, so an interrupted write never leaves a
+// partially written file.
+func (r *Recorder) writeFile() error {
+	if r.Writer != nil {
+		// Written once when closing
+		r.dirty = true
+		return nil
+	}
+	if r.Filename == "" {
+		return nil
+	}
+	data, bodies, err := r.encode(r.entries, "")
+	if err != nil {
+		return err
+	}
+	if r.DryRun {
+		r.dirty = false
+		return nil
+	}
+
+	dirMode := r.DirMode
+	if dirMode == 0 {
+		dirMode = 0750
+	}
+	dir := path.Dir(r.Filename)
+	if err := os.MkdirAll(dir, dirMode); err != nil {
+		return err
+	}
+	fileMode := r.FileMode
+	if fileMode == 0 {
+		fileMode = 0644
+	}
+
+	for name, body := range bodies {
+		if err := writeAtomic(path.Join(dir, name), []byte(body), fileMode); err != nil {
+			return err
+		}
+	}
+	if err := writeAtomic(r.Filename, data, fileMode); err != nil {
+		return err
+	}
+	if err := removeBodyFiles(r.Filename, bodies); err != nil {
+		return err
+	}
+	r.dirty = false
+	return nil
+}
+
+// appendFile saves a newly recorded entry. If the codec supports it and the
+// file is up to date, the entry is appended to the end of the file. Otherwise
+// the whole file is rewritten.
+func (r *Recorder) appendFile(e Entry) error {
+	c, ok := r.codec().(interface {
+		appendEntry(w io.Writer, e Entry) error
+	})
+	if !ok || r.dirty || r.Filename == "" || r.Compress || r.PrettyJSON ||
+		r.BodyFileThreshold > 0 || r.DryRun || r.OnWrite != nil || r.Writer != nil {
+		return r.writeFile()
+	}
+	var buf bytes.Buffer
+	if r.GRPCWebFrames {
+		e = withFrames(e)
+	}
+	if r.OrderedHeaders {
+		e = withHeaderLists(e)
+	}
+	if err := c.appendEntry(&buf, e); err != nil {
+		return err
+	}
+	dirMode := r.DirMode
+	if dirMode == 0 {
+		dirMode = 0750
+	}
+	if err := os.MkdirAll(path.Dir(r.Filename), dirMode); err != nil {
+		return err
+	}
+	fileMode := r.FileMode
+	if fileMode == 0 {
+		fileMode = 0644
+	}
+	f, err := os.OpenFile(r.Filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, fileMode)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close() // nolint: errcheck
+		return err
+	}
+	return f.Close()
+}
+
+// writeAtomic writes data to a temporary file, which is then renamed to
+// filename, so an interrupted write never leaves a partially written file.
+// New files are created with mode, minus the umask, and existing files keep
+// their permissions.
+func writeAtomic(filename string, data []byte, mode os.FileMode) error {
+	f, err := createTemp(filename, mode)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) // nolint: errcheck
+	if _, err := f.Write(data); err != nil {
+		f.Close() // nolint: errcheck
+		return err
+	}
+	if fi, err := os.Stat(filename); err == nil {
+		if err := f.Chmod(fi.Mode().Perm()); err != nil {
+			f.Close() // nolint: errcheck
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filename)
+}
+
+// createTemp creates a new temporary file next to filename. Unlike
+// ioutil.TempFile, the file is created with mode so the umask applies.
+func createTemp(filename string, mode os.FileMode) (*os.File, error) {
+	for i := 0; ; i++ {
+		name := filename + ".tmp" + strconv.FormatUint(uint64(rand.Uint32()), 10)
+		f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+		if os.IsExist(err) && i < 100 {
+			continue
+		}
+		return f, err
+	}
+}
+
+// encode encodes the entries for saving, after the separator sep. If
+// BodyFileThreshold is set, the returned map contains the bodies to save in
+// separate files.
+func (r *Recorder) encode(entries []Entry, sep string) ([]byte, map[string]string, error) {
+	if r.PrettyJSON {
+		indented := make([]Entry, len(entries))
+		for i, e := range entries {
+			indented[i] = indentEntry(e)
+		}
+		entries = indented
+	}
+	var bodies map[string]string
+	if r.BodyFileThreshold > 0 && r.Writer == nil {
+		entries, bodies = splitBodyFiles(r.Filename, entries, r.BodyFileThreshold)
+	}
+	if r.GRPCWebFrames || r.OrderedHeaders {
+		out := make([]Entry, len(entries))
+		for i, e := range entries {
+			if r.GRPCWebFrames {
+				e = withFrames(e)
+			}
+			if r.OrderedHeaders {
+				e = withHeaderLists(e)
+			}
+			out[i] = e
+		}
+		entries = out
+	}
+	var buf bytes.Buffer
+	buf.WriteString(sep)
+	if err := r.codec().Encode(&buf, entries); err != nil {
+		return nil, nil, err
+	}
+
+	data := buf.Bytes()
+	if r.Compress {
+		var zbuf bytes.Buffer
+		zw := gzip.NewWriter(&zbuf)
+		if _, err := zw.Write(data); err != nil {
+			return nil, nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, nil, err
+		}
+		data = zbuf.Bytes()
+	}
+	if r.OnWrite != nil {
+		r.OnWrite(data)
+	}
+	return data, bodies, nil
+}
+
+// writeTo writes the entries that have not been written yet to Writer. Later
+// entries are appended after the separator of the codec.
+func (r *Recorder) writeTo() error {
+	if r.written > len(r.entries) {
+		// Entries were deleted or replaced in Record mode
+		r.written = len(r.entries)
+	}
+	var sep string
+	if r.written > 0 {
+		if r.written == len(r.entries) {
+			r.dirty = false
+			return nil
+		}
+		c, ok := r.codec().(interface{ separator() string })
+		if !ok {
+			return fmt.Errorf("%T cannot append entries to Writer after they have been written", r.codec())
+		}
+		sep = c.separator()
+	}
+	data, _, err := r.encode(r.entries[r.written:], sep)
+	if err != nil {
+		return err
+	}
+	if !r.DryRun {
+		if _, err := r.Writer.Write(data); err != nil {
+			return err
+		}
+	}
+	r.written = len(r.entries)
+	r.dirty = false
+	return nil
+}
+
+// Close saves any entries that have been added or deleted since the file was
+// last written. Recorded requests are saved immediately, so there is usually
+// nothing to save. It is safe to call Close multiple times, and it is
+// recommended to defer it after creating a recorder:
+//
+//     rec := recorder.New("testdata/api")
+//     defer rec.Close()
+func (r *Recorder) Close() error {
+	r.entriesMu.Lock()
+	defer r.entriesMu.Unlock()
+	if !r.dirty {
+		return nil
+	}
+	if r.modeErr != nil {
+		return r.modeErr
+	}
+	if r.Writer != nil {
+		return r.writeTo()
+	}
+	return r.writeFile()
+}
+
+// selectExact selects an entry with the same method, URL, headers and body as
+// the request. Only headers present in the recorded entry are compared, so
+// headers removed by filters are ignored. Returns MismatchError if entries
+// exist for the method and URL, but none of them match.
+func (r *Recorder) selectExact(req *http.Request) (Entry, bool, error) {
+	body := readBody(req)
+	var candidates []Entry
+	for _, e := range r.entries {
+		if r.matchMethodURL(e, req) {
+			candidates = append(candidates, e)
+		}
+	}
+	for _, e := range candidates {
+		if !r.bodyless(req.Method) && !matchBody(e.Request, body, r.BodyMatcher) {
+			continue
+		}
+		match := true
+		for k, v := range e.Request.Headers {
+			if containsFold(r.IgnoreHeaders, k) {
+				continue
+			}
+			if req.Header.Get(k) != v {
+				match = false
+				break
+			}
+		}
+		if match {
+			return e, true, nil
+		}
+	}
+	if len(candidates) > 0 {
+		return Entry{}, false, MismatchError{Request: req, Entry: candidates[0]}
+	}
+	return Entry{}, false, nil
+}
+
+// replay returns the response for a recorded entry.
+func (r *Recorder) replay(req *http.Request, e Entry) (*http.Response, error) {
+	r.countMu.Lock()
+	r.replayed++
+	r.countMu.Unlock()
+	r.countBytes(e)
+	if e.Delay > 0 {
+		t := time.NewTimer(e.Delay)
+		select {
+		case <-t.C:
+		case <-req.Context().Done():
+			t.Stop()
+			return nil, req.Context().Err()
+		}
+	}
+	if e.Error != "" {
+		return nil, errors.New(e.Error)
+	}
+	if e.Response == nil {
+		return nil, fmt.Errorf("recorded entry for %s %s has no response", e.Request.Method, e.Request.URL)
+	}
+	resp := newResponse(req, e)
+	if r.StreamBody && len(e.Response.Chunks) > 0 {
+		resp.Body = &chunkReader{ctx: req.Context(), chunks: e.Response.Chunks}
+		resp.ContentLength = -1
+	}
+	return resp, nil
+}
+
+func (r *Recorder) selectEntry(req *http.Request) (Entry, bool) {
+	if r.Selector != nil {
+		return r.Selector.Select(r.entries, req)
+	}
+	if !r.MatchHost && r.BodyMatcher == nil && r.IgnorePathSegments == nil && r.MethodOverrideHeader == "" && r.MatchURL == nil {
+		return r.lookup(req.Method, req.URL.String())
+	}
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	var body []byte
+	if r.BodyMatcher != nil {
+		body = readBody(req)
+	}
+	for _, e := range r.entries {
+		if !r.matchMethodURL(e, req) {
+			continue
+		}
+		if r.MatchHost && !strings.EqualFold(e.Request.host(), host) {
+			continue
+		}
+		if r.BodyMatcher != nil && !r.bodyless(req.Method) && !matchBody(e.Request, body, r.BodyMatcher) {
+			continue
+		}
+		return e, true
+	}
+	return Entry{}, false
+}
+
+// matchMethodURL reports whether the entry has the same method and URL as the
+// request, taking MethodOverrideHeader, MatchURL and IgnorePathSegments into
+// account.
+func (r *Recorder) matchMethodURL(e Entry, req *http.Request) bool {
+	if r.IgnorePathSegments == nil && r.MethodOverrideHeader == "" && r.MatchURL == nil {
+		return matchMethodURL(e, req)
+	}
+	method := req.Method
+	recordedMethod := e.Request.Method
+	if r.MethodOverrideHeader != "" {
+		if v := req.Header.Get(r.MethodOverrideHeader); v != "" {
+			method = v
+		}
+		if v := e.Request.Header(r.MethodOverrideHeader); v != "" {
+			recordedMethod = v
+		}
+	}
+	if !strings.EqualFold(recordedMethod, method) {
+		return false
+	}
+	recordedURL, reqURL := e.Request.URL, req.URL.String()
+	if r.MatchURL != nil {
+		recorded := e.Request.httpRequest()
+		if recorded == nil {
+			return false
+		}
+		recordedURL, reqURL = r.MatchURL(recorded), r.MatchURL(req)
+	}
+	if r.IgnorePathSegments == nil {
+		return equalURL(recordedURL, reqURL)
+	}
+	a, err := url.Parse(recordedURL)
+	if err != nil {
+		return false
+	}
+	b, err := url.Parse(reqURL)
+	if err != nil {
+		return false
+	}
+	a.Path, a.RawPath = r.normalizePath(a.Path), ""
+	b.Path, b.RawPath = r.normalizePath(b.Path), ""
+	return equalURL(a.String(), b.String())
+}
+
+// canonicalURL returns the URL with the query parameters sorted by name, so
+// the order the parameters were added in does not matter. Parameters with the
+// same name keep their order, and their encoding is not changed.
+func canonicalURL(u string) string {
+	i := strings.IndexByte(u, '?')
+	if i < 0 {
+		return u
+	}
+	query, fragment := u[i+1:], ""
+	if j := strings.IndexByte(query, '#'); j >= 0 {
+		query, fragment = query[:j], query[j:]
+	}
+	params := strings.Split(query, "&")
+	sort.SliceStable(params, func(a, b int) bool {
+		return queryName(params[a]) < queryName(params[b])
+	})
+	return u[:i+1] + strings.Join(params, "&") + fragment
+}
+
+func queryName(param string) string {
+	if i := strings.IndexByte(param, '='); i >= 0 {
+		return param[:i]
+	}
+	return param
+}
+
+// equalURL reports whether the URLs are equal, ignoring case and the order of
+// query parameters.
+func equalURL(a, b string) bool {
+	return strings.EqualFold(canonicalURL(a), canonicalURL(b))
+}
+
+// normalizePath replaces the path segments ignored by IgnorePathSegments with
+// a placeholder.
+func (r *Recorder) normalizePath(p string) string {
+	segments := strings.Split(p, "/")
+	for i, s := range segments {
+		if s != "" && r.IgnorePathSegments(s) {
+			segments[i] = "*"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// matchBody reports whether the body of the recorded request matches the
+// incoming body, using the matcher if set. Hashed bodies must be identical.
+func matchBody(recorded *Request, body []byte, m BodyMatcher) bool {
+	body = normalizeMultipartBody(recorded.Body, body)
+	switch {
+	case recorded.BodyHash != "":
+		return matchBodyHash(recorded.BodyHash, body)
+	case m != nil:
+		return m.MatchBody([]byte(recorded.Body), body)
+	default:
+		return recorded.Body == string(body)
+	}
+}
+
+func sameResponse(a, b Entry) bool {
+	if a.Error != b.Error {
+		return false
+	}
+	if a.Response == nil || b.Response == nil {
+		return a.Response == b.Response
+	}
+	return a.Response.StatusCode == b.Response.StatusCode &&
+		a.Response.Body == b.Response.Body &&
+		a.Response.BodyHash == b.Response.BodyHash
+}
+
+const timestampLayout = "2006-01-02 15:04:05 -0700 MST"
+
+// parseTiming parses the timestamp and roundtrip duration from the comments
+// of an entry. Missing or invalid values are ignored.
+func parseTiming(b []byte) (time.Time, time.Duration) {
+	var ts time.Time
+	var dur time.Duration
+	for _, line := range strings.Split(string(b), "\n") {
+		switch {
+		case strings.HasPrefix(line, "# timestamp "):
+			ts, _ = time.Parse(timestampLayout, strings.TrimPrefix(line, "# timestamp "))
+		case strings.HasPrefix(line, "# roundtrip "):
+			dur, _ = time.ParseDuration(strings.TrimPrefix(line, "# roundtrip "))
+		}
+	}
+	return ts, dur
+}
+
+// captureReader records up to max bytes read from the underlying reader.
+type captureReader struct {
+	io.ReadCloser
+	max int
+
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (c *captureReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.mu.Lock()
+	if rem := c.max - c.buf.Len(); rem > 0 {
+		if rem > n {
+			rem = n
+		}
+		c.buf.Write(p[:rem])
+	}
+	c.mu.Unlock()
+	return n, err
+}
+
+func (c *captureReader) String() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.buf.String()
+}
+
+// newResponse constructs a response from a recorded entry. The entry is
+// attached to the context of the response's request.
+func newResponse(req *http.Request, e Entry) *http.Response {
+	ctx := context.WithValue(req.Context(), entryContextKey{}, e)
+	resp := &http.Response{
+		StatusCode:    e.Response.StatusCode,
+		Header:        e.Response.header(),
+		Body:          ioutil.NopCloser(strings.NewReader(e.Response.Body)),
+		ContentLength: int64(len(e.Response.Body)),
+		Request:       req.WithContext(ctx),
+	}
+	if len(e.Response.TransferEncoding) > 0 {
+		resp.TransferEncoding = e.Response.TransferEncoding
+		if e.Response.TransferEncoding[0] == "chunked" {
+			resp.ContentLength = -1
+		}
+	}
+	if e.Response.NoBody && e.Response.Body == "" {
+		resp.Body = http.NoBody
+	}
+	return resp
+}
+
+type entryContextKey struct{}
+
+// EntryFromResponse returns the recorded Entry that produced the response.
+//
+// Returns false if the response was not returned by a Recorder.
+func EntryFromResponse(resp *http.Response) (Entry, bool) {
+	if resp == nil || resp.Request == nil {
+		return Entry{}, false
+	}
+	e, ok := resp.Request.Context().Value(entryContextKey{}).(Entry)
+	return e, ok
+}
+
+type withoutRecordingKey struct{}
+
+// WithoutRecording returns a context that makes the recorder pass requests
+// using it directly to the transport, regardless of the mode. The requests are
+// neither replayed nor recorded. This is useful for setup requests with
+// responses that change on every run, such as fetching a CSRF token:
+//
+//     req = req.WithContext(recorder.WithoutRecording(req.Context()))
+func WithoutRecording(ctx context.Context) context.Context {
+	return context.WithValue(ctx, withoutRecordingKey{}, true)
+}
+
+// Lookup returns an existing entry matching the given method and url.
+//
+// The method and url are case-insensitive, and the order of query parameters
+// with different names is ignored.
+//
+// Returns false if no such entry exists.
+func (r *Recorder) Lookup(method, url string) (Entry, bool) {
+	r.once.Do(r.loadFromDisk)
+	r.entriesMu.RLock()
+	defer r.entriesMu.RUnlock()
+	return r.lookup(method, url)
+}
+
+// lookup is Lookup without locking. The caller must hold entriesMu.
+func (r *Recorder) lookup(method, url string) (Entry, bool) {
+	for _, e := range r.entries {
+		if strings.EqualFold(e.Request.Method, method) && equalURL(e.Request.URL, url) {
+			return e, true
+		}
+	}
+	return Entry{}, false
+}
+
+// Add adds entries to the recorder, after any entries loaded from disk. The
+// entries are replayed like recorded ones. This allows replaying entries
+// imported from other formats, for example with ImportHAR:
+//
+//     entries, err := recorder.ImportHAR(f)
+//     if err != nil {
+//         t.Fatal(err)
+//     }
+//     rec := &recorder.Recorder{Mode: recorder.ReplayOnly}
+//     rec.Add(entries...)
+//
+// The entries are not saved to disk until the next recorded request or call
+// to Save or Close.
+func (r *Recorder) Add(entries ...Entry) {
+	r.once.Do(r.loadFromDisk)
+	r.entriesMu.Lock()
+	defer r.entriesMu.Unlock()
+	r.entries = append(r.entries, entries...)
+	r.dirty = true
+}
+
+// Delete removes all entries matching the given method and url. The method
+// and url are case-insensitive. Returns true if any entries were removed.
+//
+// The file on disk is not modified until the next recorded request or call to
+// Save or Close:
+//
+//     if rec.Delete("GET", "https://example.com/stale") {
+//         err := rec.Save()
+//     }
+func (r *Recorder) Delete(method, url string) bool {
+	r.once.Do(r.loadFromDisk)
+	r.entriesMu.Lock()
+	defer r.entriesMu.Unlock()
+	kept := r.entries[:0]
+	for _, e := range r.entries {
+		if strings.EqualFold(e.Request.Method, method) && equalURL(e.Request.URL, url) {
+			continue
+		}
+		kept = append(kept, e)
+	}
+	deleted := len(kept) != len(r.entries)
+	r.entries = kept
+	if deleted {
+		r.dirty = true
+	}
+	return deleted
+}
+
+// Merge adds entries to the recorder, replacing existing entries with the same
+// method and URL in place, and saves the file. If a BodyMatcher is set, the
+// request bodies must match too. Existing entries that are not replaced are
+// kept in their original order. This allows refreshing some entries of a
+// recording with entries recorded elsewhere:
+//
+//     fresh := recorder.New("testdata/prod-capture").Entries()
+//     err := rec.Merge(fresh)
+//
+// If several new entries match the same method and URL, they replace the
+// matching existing entries in order. New entries without a matching existing
+// entry are added to the end.
+func (r *Recorder) Merge(entries []Entry) error {
+	r.once.Do(r.loadFromDisk)
+	r.entriesMu.Lock()
+	defer r.entriesMu.Unlock()
+	replaced := make(map[int]bool)
+	for _, e := range entries {
+		i := r.mergeIndex(e, replaced)
+		if i < 0 {
+			r.entries = append(r.entries, e)
+			continue
+		}
+		r.entries[i] = e
+		replaced[i] = true
+	}
+	r.dirty = true
+	return r.save()
+}
+
+// mergeIndex returns the index of the first entry that e replaces when
+// merging, ignoring already replaced entries, or -1 if there is none.
+func (r *Recorder) mergeIndex(e Entry, replaced map[int]bool) int {
+	for i, old := range r.entries {
+		if replaced[i] {
+			continue
+		}
+		if !strings.EqualFold(old.Request.Method, e.Request.Method) || !equalURL(old.Request.URL, e.Request.URL) {
+			continue
+		}
+		if r.BodyMatcher != nil && !matchBody(old.Request, []byte(e.Request.Body), r.BodyMatcher) {
+			continue
+		}
+		return i
+	}
+	return -1
+}
+
+// ReRecord marks the first entry matching the given method and url to be
+// recorded again. The next matching request in Auto or ReplayOrRecord mode is
+// sent to the transport, and the response replaces the entry in place. Other
+// entries are kept, unlike in Record mode, so a single stale entry can be
+// refreshed:
+//
+//     rec := recorder.New("testdata/api")
+//     rec.ReRecord("GET", "https://api.example.com/prices")
+//
+// The method and url are case-insensitive. Returns false if there is no
+// matching entry.
+func (r *Recorder) ReRecord(method, url string) bool {
+	if _, ok := r.Lookup(method, url); !ok {
+		return false
+	}
+	r.entriesMu.Lock()
+	r.rerecord = append(r.rerecord, Request{Method: method, URL: url})
+	r.entriesMu.Unlock()
+	return true
+}
+
+// occurrence counts the request and returns how many times a request with the
+// same method and URL has been counted.
+func (r *Recorder) occurrence(req *http.Request) int {
+	r.countMu.Lock()
+	defer r.countMu.Unlock()
+	if r.occurrences == nil {
+		r.occurrences = map[string]int{}
+	}
+	key := strings.ToUpper(req.Method) + " " + strings.ToLower(canonicalURL(req.URL.String()))
+	r.occurrences[key]++
+	return r.occurrences[key]
+}
+
+// takeReRecord returns the index of the entry to replace with the response
+// to the request if it was marked with ReRecord, or -1. The mark is removed.
+func (r *Recorder) takeReRecord(req *http.Request) int {
+	r.entriesMu.Lock()
+	defer r.entriesMu.Unlock()
+	for i, m := range r.rerecord {
+		if !strings.EqualFold(m.Method, req.Method) || !equalURL(m.URL, req.URL.String()) {
+			continue
+		}
+		r.rerecord = append(r.rerecord[:i], r.rerecord[i+1:]...)
+		for j, e := range r.entries {
+			if strings.EqualFold(e.Request.Method, m.Method) && equalURL(e.Request.URL, m.URL) {
+				return j
+			}
+		}
+		return -1
+	}
+	return -1
+}
+
+// Entries returns all recorded entries, including any loaded from disk.
+//
+// The returned entries are deep copies and may be modified freely.
+func (r *Recorder) Entries() []Entry {
+	r.once.Do(r.loadFromDisk)
+	r.entriesMu.RLock()
+	defer r.entriesMu.RUnlock()
+	out := make([]Entry, len(r.entries))
+	for i, e := range r.entries {
+		out[i] = cloneEntry(e)
+	}
+	return out
+}
+
+// cloneEntry returns a deep copy of the entry.
+func cloneEntry(e Entry) Entry {
+	if e.Request != nil {
+		req := *e.Request
+		req.Headers = cloneStrings(req.Headers)
+		req.MultiHeaders = cloneMulti(req.MultiHeaders)
+		req.HeaderList = append(HeaderList(nil), req.HeaderList...)
+		req.Frames = append([]Frame(nil), req.Frames...)
+		e.Request = &req
+	}
+	if e.Response != nil {
+		resp := *e.Response
+		resp.Headers = cloneStrings(resp.Headers)
+		resp.MultiHeaders = cloneMulti(resp.MultiHeaders)
+		resp.TransferEncoding = append([]string(nil), resp.TransferEncoding...)
+		if resp.TLS != nil {
+			tls := *resp.TLS
+			resp.TLS = &tls
+		}
+		resp.Chunks = append([]Chunk(nil), resp.Chunks...)
+		resp.HeaderList = append(HeaderList(nil), resp.HeaderList...)
+		resp.Frames = append([]Frame(nil), resp.Frames...)
+		e.Response = &resp
+	}
+	return e
+}
+
+func cloneMulti(m map[string][]string) map[string][]string {
+	if m == nil {
+		return nil
+	}
+	out := make(map[string][]string, len(m))
+	for k, vv := range m {
+		out[k] = append([]string(nil), vv...)
+	}
+	return out
+}
+
+func cloneStrings(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	out := make(map[string]string, len(m))
+	for k, v := range m {
+		out[k] = v
+	}
+	return out
+}
+
+// An Entry is a single recorded request-response entry.
+//
+// If the request resulted in a transport error and RecordErrors is set,
+// Response is nil and Error contains the error message.
+type Entry struct {
+	Request  *Request  `yaml:"request" json:"request"`
+	Response *Response `yaml:"response,omitempty" json:"response,omitempty"`
+	Error    string    `yaml:"error,omitempty" json:"error,omitempty"`
+
+	// Timestamp is the time the request was sent and Duration is the time
+	// it took to receive the response. Both are zero if unknown.
+	Timestamp time.Time     `yaml:"timestamp,omitempty" json:"timestamp,omitempty"`
+	Duration  time.Duration `yaml:"duration,omitempty" json:"duration,omitempty"`
+
+	// Deadline is the time that was left until the deadline of the request
+	// context when the request was sent, as measured by Now. It is zero if the
+	// context had no deadline. The deadline set by Timeout is not included, so
+	// it doesn't add a value to every entry. It is only informational, for
+	// example to tell that a truncated response was recorded under a tight
+	// deadline, and is not used for matching.
+	Deadline time.Duration `yaml:"deadline,omitempty" json:"deadline,omitempty"`
+
+	// Delay is never recorded, but may be added by hand to wait before
+	// returning the replayed response, for example to test timeouts:
+	//
+	//     delay: 2s
+	//
+	// The wait is interrupted if the context of the request is done.
+	Delay time.Duration `yaml:"delay,omitempty" json:"delay,omitempty"`
+}
+
+// maxStringBody is the maximum number of body bytes included by Entry.String.
+const maxStringBody = 200
+
+// String returns a short human readable summary of the entry, including the
+// method, URL, status, content type and the beginning of the bodies. It is
+// intended for test failures and logging:
+//
+//     POST https://example.com/users
+//       Content-Type: application/json
+//       {"name":"test"}
+//     -> 201 Created
+//       Content-Type: application/json
+//       {"id":1}
+func (e Entry) String() string {
+	var b strings.Builder
+	if e.Request != nil {
+		fmt.Fprintf(&b, "%s %s", e.Request.Method, e.Request.URL)
+		writeSummary(&b, e.Request.Headers, e.Request.Body)
+	}
+	if e.Error != "" {
+		fmt.Fprintf(&b, "\n-> error: %s", e.Error)
+	} else if e.Response != nil {
+		fmt.Fprintf(&b, "\n-> %d %s", e.Response.StatusCode, http.StatusText(e.Response.StatusCode))
+		writeSummary(&b, e.Response.Headers, e.Response.Body)
+	}
+	return b.String()
+}
+
+func writeSummary(b *strings.Builder, headers map[string]string, body string) {
+	for _, name := range []string{"Content-Type", "Location"} {
+		if v, ok := lookupHeader(headers, name); ok {
+			fmt.Fprintf(b, "\n  %s: %s", name, v)
+		}
+	}
+	if body == "" {
+		return
+	}
+	indent := func(s string) string { return strings.Replace(s, "\n", "\n  ", -1) }
+	if len(body) <= maxStringBody {
+		fmt.Fprintf(b, "\n  %s", indent(body))
+		return
+	}
+	short := body[:maxStringBody]
+	for len(short) > 0 && !utf8.ValidString(short) {
+		short = short[:len(short)-1]
+	}
+	fmt.Fprintf(b, "\n  %s... (%d bytes)", indent(short), len(body))
+}
 
 // A Request is a recorded outgoing request.
 //
 // The headers are flattened to a simple key-value map. The underlying request
 // may contain multiple value for each key but in practice this is not very
 // common and working with a simple key-value map is much more convenient.
+// Headers are always saved sorted by name, so the output is deterministic.
+// Likewise, query parameters in the URL are sorted by name, as the order they
+// are sent in depends on how the URL was built.
 type Request struct {
-	Method  string            `yaml:"method"`
-	URL     string            `yaml:"url"`
-	Headers map[string]string `yaml:"headers,omitempty"`
-	Body    string            `yaml:"body,omitempty"`
+	Method  string            `yaml:"method" json:"method"`
+	URL     string            `yaml:"url" json:"url"`
+	Headers map[string]string `yaml:"headers,omitempty" json:"headers,omitempty"`
+	Body    string            `yaml:"body,omitempty" json:"body,omitempty"`
+
+	// MultiHeaders contains all values of headers that were sent more than
+	// once, in the order they were set. Headers only contains the first
+	// value. Values are only used if the first one is the same as in Headers,
+	// so filters that remove or modify a header in Headers also apply to its
+	// other values.
+	MultiHeaders map[string][]string `yaml:"multi_headers,omitempty" json:"multi_headers,omitempty"`
+
+	// Host is set if the request was sent with a Host header that differs
+	// from the host in the URL.
+	Host string `yaml:"host,omitempty" json:"host,omitempty"`
+
+	// RemoteAddr is the address the request was sent to, as reported by the
+	// connection. It is informational only and not used when matching.
+	RemoteAddr string `yaml:"remote_addr,omitempty" json:"remote_addr,omitempty"`
+
+	// BodyHash is set instead of Body if the body was hashed with
+	// HashRequestBody.
+	BodyHash string `yaml:"body_hash,omitempty" json:"body_hash,omitempty"`
+
+	// HeaderList contains the headers instead of Headers in files saved with
+	// OrderedHeaders. It is moved to Headers when the file is loaded.
+	HeaderList HeaderList `yaml:"header_list,omitempty" json:"header_list,omitempty"`
+
+	// Frames contains a gRPC-Web body instead of Body in files saved with
+	// GRPCWebFrames. It is joined to Body when the file is loaded.
+	Frames []Frame `yaml:"frames,omitempty" json:"frames,omitempty"`
+}
+
+// Header returns the value of the header with the given name. The name is
+// case-insensitive. Returns an empty string if the header is not set.
+func (r *Request) Header(name string) string {
+	v, _ := lookupHeader(r.Headers, name)
+	return v
+}
+
+// httpRequest returns the recorded request as an http.Request without a body.
+// Returns nil if the URL cannot be parsed.
+func (r *Request) httpRequest() *http.Request {
+	u, err := url.Parse(r.URL)
+	if err != nil {
+		return nil
+	}
+	return &http.Request{
+		Method: r.Method,
+		URL:    u,
+		Header: r.header(),
+		Host:   r.Host,
+	}
+}
+
+// host returns the Host the request was sent with.
+func (r *Request) host() string {
+	if r.Host != "" {
+		return r.Host
+	}
+	if u, err := url.Parse(r.URL); err == nil {
+		return u.Host
+	}
+	return ""
 }
 
 // A Response is a recorded incoming response.
@@ -327,20 +2398,171 @@ type Request struct {
 // The headers are flattened to a simple key-value map. The underlying request
 // may contain multiple value for each key but in practice this is not very
 // common and working with a simple key-value map is much more convenient.
+// Headers are always saved sorted by name, so the output is deterministic.
+//
+// Headers are recorded exactly as received and replayed as recorded. Headers
+// that are not in the recording, such as a Content-Type the server did not
+// send, are never added when replaying.
 type Response struct {
-	StatusCode int               `yaml:"status_code"`
-	Headers    map[string]string `yaml:"headers,omitempty"`
-	Body       string            `yaml:"body,omitempty"`
+	StatusCode int               `yaml:"status_code" json:"status_code"`
+	Headers    map[string]string `yaml:"headers,omitempty" json:"headers,omitempty"`
+	Body       string            `yaml:"body,omitempty" json:"body,omitempty"`
+
+	// MultiHeaders contains all values of headers that were received more
+	// than once, such as Set-Cookie, in the order they were received. Headers
+	// only contains the first value. Values are only used if the first one is
+	// the same as in Headers, so filters that remove or modify a header in
+	// Headers also apply to its other values.
+	MultiHeaders map[string][]string `yaml:"multi_headers,omitempty" json:"multi_headers,omitempty"`
+
+	// NoBody is set if the response did not have a body at all, such as for
+	// 204 No Content. An empty Body without NoBody is replayed as a present
+	// but empty body.
+	NoBody bool `yaml:"no_body,omitempty" json:"no_body,omitempty"`
+
+	// TransferEncoding is the transfer encoding of the response, such as
+	// chunked. Replayed chunked responses have an unknown content length,
+	// like the original response.
+	TransferEncoding []string `yaml:"transfer_encoding,omitempty" json:"transfer_encoding,omitempty"`
+
+	// TLS contains information about the connection the response was
+	// received on, if TLS was used. It is informational only and not used
+	// when matching.
+	TLS *TLS `yaml:"tls,omitempty" json:"tls,omitempty"`
+
+	// Chunks contains the body split into the parts it was received in, if
+	// StreamBody was set when recording. Body contains the full body.
+	Chunks []Chunk `yaml:"chunks,omitempty" json:"chunks,omitempty"`
+
+	// BodyHash is set instead of Body if the body was hashed with
+	// HashResponseBody.
+	BodyHash string `yaml:"body_hash,omitempty" json:"body_hash,omitempty"`
+
+	// BodyFile is the name of the file the body is stored in, relative to
+	// the recording, if it was larger than BodyFileThreshold. It is only set
+	// in the saved file; the body is read into Body when the file is loaded.
+	BodyFile string `yaml:"body_file,omitempty" json:"body_file,omitempty"`
+
+	// HeaderList contains the headers instead of Headers in files saved with
+	// OrderedHeaders. It is moved to Headers when the file is loaded.
+	HeaderList HeaderList `yaml:"header_list,omitempty" json:"header_list,omitempty"`
+
+	// Frames contains a gRPC-Web body instead of Body in files saved with
+	// GRPCWebFrames. It is joined to Body when the file is loaded.
+	Frames []Frame `yaml:"frames,omitempty" json:"frames,omitempty"`
+}
+
+// A Chunk is a part of a streamed response body.
+type Chunk struct {
+	// Delay is the time between receiving the previous chunk, or the
+	// response headers for the first chunk, and this chunk.
+	Delay time.Duration `yaml:"delay,omitempty" json:"delay,omitempty"`
+	Data  string        `yaml:"data" json:"data"`
+}
+
+// TLS is recorded information about a TLS connection.
+type TLS struct {
+	Version     string `yaml:"version" json:"version"`
+	CipherSuite string `yaml:"cipher_suite" json:"cipher_suite"`
+
+	// PeerSubject is the subject of the certificate presented by the server.
+	PeerSubject string `yaml:"peer_subject,omitempty" json:"peer_subject,omitempty"`
+}
+
+func newTLS(state *tls.ConnectionState) *TLS {
+	if state == nil {
+		return nil
+	}
+	out := &TLS{
+		Version:     fmt.Sprintf("0x%04x", state.Version),
+		CipherSuite: fmt.Sprintf("0x%04x", state.CipherSuite),
+	}
+	switch state.Version {
+	case tls.VersionTLS10:
+		out.Version = "TLS 1.0"
+	case tls.VersionTLS11:
+		out.Version = "TLS 1.1"
+	case tls.VersionTLS12:
+		out.Version = "TLS 1.2"
+	case tls.VersionTLS13:
+		out.Version = "TLS 1.3"
+	}
+	if len(state.PeerCertificates) > 0 {
+		out.PeerSubject = state.PeerCertificates[0].Subject.String()
+	}
+	return out
+}
+
+// Header returns the value of the header with the given name. The name is
+// case-insensitive. Returns an empty string if the header is not set.
+func (r *Response) Header(name string) string {
+	v, _ := lookupHeader(r.Headers, name)
+	return v
 }
 
 func flattenHeader(in http.Header) map[string]string {
 	out := make(map[string]string, len(in))
 	for k, vv := range in {
-		out[k] = vv[0]
+		if len(vv) > 0 {
+			out[k] = vv[0]
+		}
+	}
+	return out
+}
+
+// multiHeaders returns the headers that have more than one value, or nil if
+// there are none.
+func multiHeaders(in http.Header) map[string][]string {
+	var out map[string][]string
+	for k, vv := range in {
+		if len(vv) < 2 {
+			continue
+		}
+		if out == nil {
+			out = make(map[string][]string)
+		}
+		out[k] = append([]string(nil), vv...)
 	}
 	return out
 }
 
+// pruneMultiHeaders removes the values of headers that have been removed or
+// modified in headers, such as by filters.
+func pruneMultiHeaders(headers map[string]string, multi map[string][]string) map[string][]string {
+	for k, vv := range multi {
+		if len(vv) == 0 || headers[k] != vv[0] {
+			delete(multi, k)
+		}
+	}
+	if len(multi) == 0 {
+		return nil
+	}
+	return multi
+}
+
+func gunzip(b []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return ioutil.ReadAll(zr)
+}
+
+// lookupHeader returns the value of a flattened header, ignoring the case of
+// the name.
+func lookupHeader(headers map[string]string, name string) (string, bool) {
+	if v, ok := headers[textproto.CanonicalMIMEHeaderKey(name)]; ok {
+		return v, true
+	}
+	for k, v := range headers {
+		if strings.EqualFold(k, name) {
+			return v, true
+		}
+	}
+	return "", false
+}
+
 func expandHeader(in map[string]string) http.Header {
 	out := make(http.Header, len(in))
 	for k, v := range in {
@@ -349,30 +2571,60 @@ func expandHeader(in map[string]string) http.Header {
 	return out
 }
 
-// OncePerCall is a Selector that selects entries based on the method and URL,
-// but it will only select any given entry at most once.
-type OncePerCall struct {
-	mu   sync.Mutex
-	used map[int]bool
+// indentEntry returns a copy of the entry with compact JSON bodies indented.
+func indentEntry(e Entry) Entry {
+	if e.Request != nil && isJSON(e.Request.Header("Content-Type")) {
+		req := *e.Request
+		req.Body = indentJSON(req.Body)
+		e.Request = &req
+	}
+	if e.Response != nil && isJSON(e.Response.Header("Content-Type")) {
+		resp := *e.Response
+		resp.Body = indentJSON(resp.Body)
+		e.Response = &resp
+	}
+	return e
+}
+
+// compactEntry reverses indentEntry.
+func compactEntry(e *Entry) {
+	if e.Request != nil && isJSON(e.Request.Header("Content-Type")) {
+		e.Request.Body = compactJSON(e.Request.Body)
+	}
+	if e.Response != nil && isJSON(e.Response.Header("Content-Type")) {
+		e.Response.Body = compactJSON(e.Response.Body)
+	}
 }
 
-// Select implements Selector and chooses an entry.
-func (s *OncePerCall) Select(entries []Entry, req *http.Request) (Entry, bool) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	if s.used == nil {
-		s.used = map[int]bool{}
+// indentJSON indents the body if it is compact JSON. A trailing newline is
+// preserved. Other bodies are returned as is.
+func indentJSON(body string) string {
+	trimmed := strings.TrimSuffix(body, "\n")
+	var compact, indented bytes.Buffer
+	if json.Compact(&compact, []byte(trimmed)) != nil || compact.String() != trimmed {
+		return body
 	}
-	for i, e := range entries {
-		if !strings.EqualFold(e.Request.Method, req.Method) {
-			continue
-		} else if !strings.EqualFold(e.Request.URL, req.URL.String()) {
-			continue
-		}
-		if !s.used[i] {
-			s.used[i] = true
-			return e, true
-		}
+	if json.Indent(&indented, compact.Bytes(), "", "  ") != nil {
+		return body
 	}
-	return Entry{}, false
+	return indented.String() + body[len(trimmed):]
+}
+
+// compactJSON reverses indentJSON. Bodies that were not indented by
+// indentJSON are returned as is.
+func compactJSON(body string) string {
+	trimmed := strings.TrimSuffix(body, "\n")
+	var compact bytes.Buffer
+	if json.Compact(&compact, []byte(trimmed)) != nil {
+		return body
+	}
+	if indentJSON(compact.String()) != trimmed {
+		return body
+	}
+	return compact.String() + body[len(trimmed):]
+}
+
+func isJSON(contentType string) bool {
+	mt, _, err := mime.ParseMediaType(contentType)
+	return err == nil && (mt == "application/json" || strings.HasSuffix(mt, "+json"))
 }
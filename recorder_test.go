@@ -2,20 +2,32 @@ package recorder_test
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/http/cookiejar"
 	"net/http/httptest"
 	"net/http/httputil"
 	"net/url"
 	"os"
 	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/akupila/recorder"
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
 )
 
 func TestMain(m *testing.M) {
@@ -26,6 +38,21 @@ func TestMain(m *testing.M) {
 	os.Exit(code)
 }
 
+// removeRecording removes the files of a recording left by a previous run,
+// such as with -count, so the test starts without a recording.
+func removeRecording(t *testing.T, name string) {
+	t.Helper()
+	files, err := filepath.Glob(name + ".*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range append(files, name) {
+		if err := os.RemoveAll(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
 func Example() {
 	// Create a new recorder.
 	// Data will be saved in testdata/example.yml
@@ -117,6 +144,18 @@ func ExampleNoRequestError() {
 	}
 }
 
+func ExampleErrNoRequest() {
+	rec := recorder.New("notfound")
+
+	// Disallow network traffic so this returns an error.
+	rec.Mode = recorder.ReplayOnly
+
+	cli := &http.Client{Transport: rec}
+	if _, err := cli.Get("https://example.com"); errors.Is(err, recorder.ErrNoRequest) {
+		// Recorded entry was not found.
+	}
+}
+
 func TestRoundTrip_Default_replay(t *testing.T) {
 	requests := 0
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -316,7 +355,8 @@ func TestRoundTrip_Data(t *testing.T) {
 			Headers: map[string]string{
 				"Authorization": "abc",
 			},
-			Body: `{"hello": "world"}`,
+			Body:       `{"hello": "world"}`,
+			RemoteAddr: ts.Listener.Addr().String(),
 		},
 		Response: &recorder.Response{
 			StatusCode: 200,
@@ -361,6 +401,7 @@ func TestRoundTrip_Data(t *testing.T) {
 		}, cmp.Comparer(func(a, b map[string]string) bool {
 			return len(a) == len(b)
 		})),
+		cmpopts.IgnoreFields(recorder.Entry{}, "Timestamp", "Duration"),
 	}
 	if diff := cmp.Diff(got, want, opts...); diff != "" {
 		t.Errorf("Returned entry does not match (-got, +want)\n%s", diff)
@@ -591,3 +632,3089 @@ func TestNewWithExistingEmptyFileDoesntCrashIssue2(t *testing.T) {
 		t.Fatal("get:", err)
 	}
 }
+
+func TestRoundTrip_RemoteAddr(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}))
+	defer ts.Close()
+
+	rec := recorder.New("testdata/remote-addr")
+	rec.Mode = recorder.Passthrough
+	cli := &http.Client{Transport: rec}
+
+	_, err := cli.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, ok := rec.Lookup(http.MethodGet, ts.URL)
+	if !ok {
+		t.Fatalf("Entry was not recorded")
+	}
+	want := ts.Listener.Addr().String()
+	if got.Request.RemoteAddr != want {
+		t.Errorf("Remote address = %q, want %q", got.Request.RemoteAddr, want)
+	}
+}
+
+func TestRoundTrip_Compress(t *testing.T) {
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		fmt.Fprintf(w, "hello %s", r.URL.Path)
+	}))
+	defer ts.Close()
+
+	rec := recorder.New("testdata/compress")
+	rec.Compress = true
+	cli := &http.Client{Transport: rec}
+
+	for _, p := range []string{"/a", "/b"} {
+		if _, err := cli.Get(ts.URL + p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f, err := os.Open("testdata/compress.yml.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("Saved file is not compressed: %v", err)
+	}
+	saved, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(saved, []byte("hello /b")) {
+		t.Errorf("Saved file does not contain second entry\n\n%s", saved)
+	}
+
+	// Replay from the compressed file, inferring compression from the name
+	rec = recorder.New("testdata/compress.yml.gz")
+	rec.Mode = recorder.ReplayOnly
+	cli = &http.Client{Transport: rec}
+
+	resp, err := cli.Get(ts.URL + "/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "hello /b" {
+		t.Errorf("Replayed body = %q, want %q", body, "hello /b")
+	}
+	if requests != 2 {
+		t.Errorf("Got %d outgoing requests, want %d", requests, 2)
+	}
+}
+
+func TestEntries(t *testing.T) {
+	removeRecording(t, "testdata/entries")
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Path", r.URL.Path)
+		w.WriteHeader(200)
+	}))
+	defer ts.Close()
+
+	rec := recorder.New("testdata/entries")
+	rec.Mode = recorder.Record
+	cli := &http.Client{Transport: rec}
+
+	for _, p := range []string{"/a", "/b", "/c"} {
+		if _, err := cli.Get(ts.URL + p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Load the entries from disk
+	rec = recorder.New("testdata/entries")
+	entries := rec.Entries()
+
+	var got []string
+	for _, e := range entries {
+		got = append(got, e.Request.URL)
+	}
+	want := []string{ts.URL + "/a", ts.URL + "/b", ts.URL + "/c"}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("Entries do not match (-got, +want)\n%s", diff)
+	}
+
+	// Modifying the returned slice does not affect the recorder
+	entries[0] = recorder.Entry{}
+	if rec.Entries()[0].Request == nil {
+		t.Errorf("Modifying returned entries changed the recorder")
+	}
+
+	// Neither does modifying the requests and responses of the entries
+	e := entries[1]
+	e.Request.URL = "modified"
+	e.Response.Body = "modified"
+	e.Response.Headers["X-Path"] = "modified"
+	if got := rec.Entries()[1]; got.Request.URL != ts.URL+"/b" || got.Response.Body != "" ||
+		got.Response.Headers["X-Path"] != "/b" {
+		t.Errorf("Modifying returned entry changed the recorder: %+v %+v", got.Request, got.Response)
+	}
+}
+
+func TestEntryFromResponse(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello")) // nolint: errcheck
+	}))
+	defer ts.Close()
+
+	rec := recorder.New("testdata/entry-from-response")
+	cli := &http.Client{Transport: rec}
+
+	// First request is recorded, second is replayed
+	for i := 0; i < 2; i++ {
+		resp, err := cli.Get(ts.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		e, ok := recorder.EntryFromResponse(resp)
+		if !ok {
+			t.Fatalf("Request %d: no entry attached to response", i)
+		}
+		if e.Request.URL != ts.URL {
+			t.Errorf("Request %d: entry url = %q, want %q", i, e.Request.URL, ts.URL)
+		}
+		if e.Response.Body != "hello" {
+			t.Errorf("Request %d: entry body = %q, want %q", i, e.Response.Body, "hello")
+		}
+	}
+
+	if _, ok := recorder.EntryFromResponse(&http.Response{}); ok {
+		t.Errorf("Got entry for response not returned by recorder")
+	}
+}
+
+func TestSkip(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "hello %s", r.URL.Path)
+	}))
+	defer ts.Close()
+
+	rec := recorder.New("testdata/skip")
+	rec.Skip = func(e *recorder.Entry) bool {
+		return strings.HasSuffix(e.Request.URL, "/health")
+	}
+	cli := &http.Client{Transport: rec}
+
+	for _, p := range []string{"/health", "/data"} {
+		resp, err := cli.Get(ts.URL + p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "hello " + p; string(body) != want {
+			t.Errorf("Body = %q, want %q", body, want)
+		}
+	}
+
+	if _, ok := rec.Lookup(http.MethodGet, ts.URL+"/health"); ok {
+		t.Errorf("Skipped entry was kept in memory")
+	}
+	if _, ok := rec.Lookup(http.MethodGet, ts.URL+"/data"); !ok {
+		t.Errorf("Entry was not recorded")
+	}
+
+	saved, err := ioutil.ReadFile("testdata/skip.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(saved, []byte("/health")) {
+		t.Errorf("Saved file contains skipped entry\n\n%s", saved)
+	}
+}
+
+func TestRoundTrip_Verify(t *testing.T) {
+	version := "v1"
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		fmt.Fprintf(w, "%s %s", r.URL.Path, version)
+	}))
+	defer ts.Close()
+
+	rec := recorder.New("testdata/verify")
+	rec.Mode = recorder.Record
+	cli := &http.Client{Transport: rec}
+	for _, p := range []string{"/a", "/b"} {
+		if _, err := cli.Get(ts.URL + p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	saved, err := ioutil.ReadFile("testdata/verify.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	version = "v2"
+	var mismatches []string
+	rec = recorder.New("testdata/verify")
+	rec.Mode = recorder.Verify
+	rec.OnMismatch = func(recorded, live recorder.Entry) {
+		mismatches = append(mismatches, recorded.Response.Body+" -> "+live.Response.Body)
+	}
+	cli = &http.Client{Transport: rec}
+
+	resp, err := cli.Get(ts.URL + "/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "/a v2" {
+		t.Errorf("Body = %q, want live response %q", body, "/a v2")
+	}
+	if requests != 3 {
+		t.Errorf("Got %d outgoing requests, want %d", requests, 3)
+	}
+	if diff := cmp.Diff(mismatches, []string{"/a v1 -> /a v2"}); diff != "" {
+		t.Errorf("Mismatches do not match (-got, +want)\n%s", diff)
+	}
+
+	// Missing recordings are an error
+	_, err = cli.Get(ts.URL + "/c")
+	if uerr, ok := err.(*url.Error); !ok {
+		t.Errorf("Got error %T %v, want %T", err, err, recorder.NoRequestError{})
+	} else if _, ok := uerr.Err.(recorder.NoRequestError); !ok {
+		t.Errorf("Got error %T %v, want %T", uerr.Err, uerr.Err, recorder.NoRequestError{})
+	}
+
+	// Recording is not modified
+	after, err := ioutil.ReadFile("testdata/verify.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(saved, after) {
+		t.Errorf("Recording was modified in verify mode")
+	}
+}
+
+func TestRoundTrip_FileMode(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}))
+	defer ts.Close()
+
+	rec := recorder.New("testdata/modes/file")
+	rec.FileMode = 0600
+	rec.DirMode = 0700
+	cli := &http.Client{Transport: rec}
+
+	if _, err := cli.Get(ts.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Stat("testdata/modes/file.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fi.Mode().Perm(); got != 0600 {
+		t.Errorf("File mode = %v, want %v", got, os.FileMode(0600))
+	}
+	di, err := os.Stat("testdata/modes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := di.Mode().Perm(); got != 0700 {
+		t.Errorf("Directory mode = %v, want %v", got, os.FileMode(0700))
+	}
+}
+
+func TestRoundTrip_EmptyBody(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/no-content":
+			w.WriteHeader(http.StatusNoContent)
+		case "/empty":
+			// Flushing without writing sends an empty chunked body
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer ts.Close()
+
+	testcases := []struct {
+		Path          string
+		StatusCode    int
+		NoBody        bool
+		ContentLength int64
+	}{
+		{"/no-content", http.StatusNoContent, true, 0},
+		{"/empty", http.StatusOK, false, -1}, // chunked
+	}
+
+	rec := recorder.New("testdata/empty-body")
+	rec.Mode = recorder.Record
+	cli := &http.Client{Transport: rec}
+	for _, test := range testcases {
+		if _, err := cli.Get(ts.URL + test.Path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rec = recorder.New("testdata/empty-body")
+	rec.Mode = recorder.ReplayOnly
+	cli = &http.Client{Transport: rec}
+	for _, test := range testcases {
+		resp, err := cli.Get(ts.URL + test.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != test.StatusCode {
+			t.Errorf("%s: status = %d, want %d", test.Path, resp.StatusCode, test.StatusCode)
+		}
+		if got := resp.Body == http.NoBody; got != test.NoBody {
+			t.Errorf("%s: body is http.NoBody = %t, want %t", test.Path, got, test.NoBody)
+		}
+		if resp.ContentLength != test.ContentLength {
+			t.Errorf("%s: content length = %d, want %d", test.Path, resp.ContentLength, test.ContentLength)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(body) != 0 {
+			t.Errorf("%s: body = %q, want empty", test.Path, body)
+		}
+	}
+}
+
+func TestRoundTrip_MaxRequestBodyBytes(t *testing.T) {
+	body := strings.Repeat("0123456789", 1000)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != body {
+			t.Errorf("Server received %d bytes, want %d", len(got), len(body))
+		}
+	}))
+	defer ts.Close()
+
+	rec := recorder.New("testdata/max-request-body")
+	rec.MaxRequestBodyBytes = 15
+	cli := &http.Client{Transport: rec}
+
+	if _, err := cli.Post(ts.URL, "text/plain", strings.NewReader(body)); err != nil {
+		t.Fatal(err)
+	}
+
+	e, ok := rec.Lookup(http.MethodPost, ts.URL)
+	if !ok {
+		t.Fatalf("Entry was not recorded")
+	}
+	if want := "012345678901234"; e.Request.Body != want {
+		t.Errorf("Recorded body = %q, want %q", e.Request.Body, want)
+	}
+}
+
+func TestClient(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}))
+	defer ts.Close()
+
+	rec := recorder.New("testdata/client")
+	rec.Mode = recorder.Passthrough
+	cli := rec.Client()
+
+	if cli.Transport != rec {
+		t.Errorf("Client transport is not the recorder")
+	}
+	if _, err := cli.Get(ts.URL); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := rec.Lookup(http.MethodGet, ts.URL); !ok {
+		t.Errorf("Entry was not recorded")
+	}
+}
+
+func TestRoundTrip_Proxy(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "forwarded for %s", r.Header.Get("X-Forwarded-For"))
+	}))
+	defer ts.Close()
+
+	proxied := 0
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied++
+		out, _ := http.NewRequest(r.Method, r.URL.String(), r.Body)
+		out.Header = r.Header
+		out.Header.Set("X-Forwarded-For", "10.0.0.1")
+		resp, err := http.DefaultTransport.RoundTrip(out)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		for k, vv := range resp.Header {
+			w.Header()[k] = vv
+		}
+		w.Header().Set("Via", "1.1 test-proxy")
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body) // nolint: errcheck
+	}))
+	defer proxy.Close()
+
+	proxyURL, _ := url.Parse(proxy.URL)
+
+	rec := recorder.New("testdata/proxy")
+	rec.Mode = recorder.Record
+	rec.Transport = &http.Transport{Proxy: http.ProxyURL(proxyURL)}
+	cli := &http.Client{Transport: rec}
+
+	if _, err := cli.Get(ts.URL); err != nil {
+		t.Fatal(err)
+	}
+	if proxied != 1 {
+		t.Fatalf("Got %d proxied requests, want %d", proxied, 1)
+	}
+
+	e, ok := rec.Lookup(http.MethodGet, ts.URL)
+	if !ok {
+		t.Fatalf("Entry was not recorded with the target URL")
+	}
+	if _, ok := e.Request.Headers["X-Forwarded-For"]; ok {
+		t.Errorf("Recorded request contains header added by proxy")
+	}
+
+	// Replay without the proxy
+	rec = recorder.New("testdata/proxy")
+	rec.Mode = recorder.ReplayOnly
+	cli = &http.Client{Transport: rec}
+
+	resp, err := cli.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := resp.Header.Get("Via"); got != "1.1 test-proxy" {
+		t.Errorf("Replayed Via header = %q, want %q", got, "1.1 test-proxy")
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "forwarded for 10.0.0.1"; string(body) != want {
+		t.Errorf("Replayed body = %q, want %q", body, want)
+	}
+	if proxied != 1 {
+		t.Errorf("Replayed request was sent through proxy")
+	}
+}
+
+func TestRoundTrip_RelativeURL(t *testing.T) {
+	rec := recorder.New("testdata/relative-url")
+	rec.Mode = recorder.Passthrough
+
+	for _, u := range []string{"/path", "example.com/path", "http:///path"} {
+		parsed, err := url.Parse(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := &http.Request{Method: http.MethodGet, URL: parsed, Header: http.Header{}}
+		_, err = rec.RoundTrip(req)
+		if err == nil {
+			t.Errorf("%s: Expected error for url", u)
+		} else if !strings.Contains(err.Error(), "invalid request url") {
+			t.Errorf("%s: Got error %v, want invalid request url", u, err)
+		}
+	}
+
+	if entries := rec.Entries(); len(entries) != 0 {
+		t.Errorf("Got %d recorded entries, want none", len(entries))
+	}
+}
+
+func TestRoundTrip_Host(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "tenant %s", r.Host)
+	}))
+	defer ts.Close()
+
+	hosts := []string{"a.example.com", "b.example.com"}
+
+	rec := recorder.New("testdata/host")
+	rec.Mode = recorder.Record
+	cli := &http.Client{Transport: rec}
+	for _, host := range hosts {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL, nil)
+		req.Host = host
+		if _, err := cli.Do(req); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries := rec.Entries()
+	for i, host := range hosts {
+		if entries[i].Request.Host != host {
+			t.Errorf("Entry %d: host = %q, want %q", i, entries[i].Request.Host, host)
+		}
+	}
+
+	rec = recorder.New("testdata/host")
+	rec.Mode = recorder.ReplayOnly
+	rec.MatchHost = true
+	cli = &http.Client{Transport: rec}
+	for _, host := range []string{"b.example.com", "a.example.com"} {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL, nil)
+		req.Host = host
+		resp, err := cli.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "tenant " + host; string(body) != want {
+			t.Errorf("Body = %q, want %q", body, want)
+		}
+	}
+
+	// Without a custom Host, the host of the URL is used
+	if _, err := cli.Get(ts.URL); err == nil {
+		t.Errorf("Expected error for request without recorded host")
+	}
+}
+
+func TestRoundTrip_RecordErrors(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	ts.Close() // Connections are refused
+
+	rec := recorder.New("testdata/record-errors")
+	rec.RecordErrors = true
+	cli := &http.Client{Transport: rec}
+
+	_, err := cli.Get(ts.URL)
+	if err == nil {
+		t.Fatalf("Expected error from closed server")
+	}
+
+	e, ok := rec.Lookup(http.MethodGet, ts.URL)
+	if !ok {
+		t.Fatalf("Entry was not recorded")
+	}
+	if e.Error == "" || e.Response != nil {
+		t.Fatalf("Recorded entry = %+v, want error without response", e)
+	}
+
+	rec = recorder.New("testdata/record-errors")
+	rec.Mode = recorder.ReplayOnly
+	cli = &http.Client{Transport: rec}
+
+	_, err = cli.Get(ts.URL)
+	uerr, ok := err.(*url.Error)
+	if !ok {
+		t.Fatalf("Returned error is %T, not *url.Error", err)
+	}
+	if uerr.Err.Error() != e.Error {
+		t.Errorf("Replayed error = %q, want %q", uerr.Err.Error(), e.Error)
+	}
+}
+
+func TestRoundTrip_ErrorsNotRecordedByDefault(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	ts.Close()
+
+	rec := recorder.New("testdata/errors-not-recorded")
+	cli := &http.Client{Transport: rec}
+
+	if _, err := cli.Get(ts.URL); err == nil {
+		t.Fatalf("Expected error from closed server")
+	}
+	if _, ok := rec.Lookup(http.MethodGet, ts.URL); ok {
+		t.Errorf("Failed request was recorded")
+	}
+}
+
+func TestRoundTrip_SortedHeaders(t *testing.T) {
+	names := []string{"X-Zulu", "X-Alpha", "X-Mike", "X-Charlie", "X-Yankee", "X-Bravo"}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, name := range names {
+			w.Header().Set(name, "1")
+		}
+	}))
+	defer ts.Close()
+
+	var saved [][]byte
+	for i := 0; i < 5; i++ {
+		rec := recorder.New("testdata/sorted-headers", func(e *recorder.Entry) {
+			// Remove data that varies between runs
+			delete(e.Response.Headers, "Date")
+			e.Timestamp = time.Time{}
+			e.Duration = 0
+		})
+		rec.Mode = recorder.Record
+		cli := &http.Client{Transport: rec}
+
+		req, _ := http.NewRequest(http.MethodGet, ts.URL, nil)
+		for _, name := range names {
+			req.Header.Set(name, "1")
+		}
+		if _, err := cli.Do(req); err != nil {
+			t.Fatal(err)
+		}
+
+		b, err := ioutil.ReadFile("testdata/sorted-headers.yml")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Skip comments, which contain the timestamp
+		b = b[bytes.Index(b, []byte("request:")):]
+		saved = append(saved, b)
+	}
+
+	for i := 1; i < len(saved); i++ {
+		if !bytes.Equal(saved[0], saved[i]) {
+			t.Fatalf("Saved file differs between runs\n\n%s\n\n%s", saved[0], saved[i])
+		}
+	}
+
+	var last int
+	for _, name := range []string{"X-Alpha", "X-Bravo", "X-Charlie", "X-Mike", "X-Yankee", "X-Zulu"} {
+		i := bytes.Index(saved[0][last:], []byte(name))
+		if i < 0 {
+			t.Fatalf("Header %s is not sorted in saved file\n\n%s", name, saved[0])
+		}
+		last += i
+	}
+}
+
+func TestEntryHeader(t *testing.T) {
+	e := recorder.Entry{
+		Request: &recorder.Request{
+			Headers: map[string]string{"Authorization": "abc", "x-lower": "lower"},
+		},
+		Response: &recorder.Response{
+			Headers: map[string]string{"Content-Type": "application/json"},
+		},
+	}
+
+	testcases := []struct {
+		Got, Want string
+	}{
+		{e.Request.Header("authorization"), "abc"},
+		{e.Request.Header("AUTHORIZATION"), "abc"},
+		{e.Request.Header("X-Lower"), "lower"},
+		{e.Request.Header("X-Missing"), ""},
+		{e.Response.Header("content-type"), "application/json"},
+		{e.Response.Header("Content-Type"), "application/json"},
+	}
+
+	for i, test := range testcases {
+		if test.Got != test.Want {
+			t.Errorf("Case %d: header = %q, want %q", i, test.Got, test.Want)
+		}
+	}
+}
+
+func TestRoundTrip_RecordOnlyStatus(t *testing.T) {
+	removeRecording(t, "testdata/record-only-status")
+
+	status := http.StatusInternalServerError
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(status)
+	}))
+	defer ts.Close()
+
+	rec := recorder.New("testdata/record-only-status")
+	rec.RecordOnlyStatus = func(code int) bool { return code < 400 }
+	cli := &http.Client{Transport: rec}
+
+	resp, err := cli.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != status {
+		t.Errorf("Status = %d, want %d", resp.StatusCode, status)
+	}
+	if _, ok := rec.Lookup(http.MethodGet, ts.URL); ok {
+		t.Errorf("Failed response was recorded")
+	}
+	if _, err := os.Stat("testdata/record-only-status.yml"); !os.IsNotExist(err) {
+		t.Errorf("Failed response was saved to disk")
+	}
+
+	// The request is sent again and recorded once it succeeds
+	status = http.StatusOK
+	for i := 0; i < 2; i++ {
+		if _, err := cli.Get(ts.URL); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if requests != 2 {
+		t.Errorf("Got %d outgoing requests, want %d", requests, 2)
+	}
+}
+
+func TestRoundTrip_TLS(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}))
+	defer ts.Close()
+
+	rec := recorder.New("testdata/tls")
+	rec.Transport = ts.Client().Transport
+	cli := &http.Client{Transport: rec}
+
+	if _, err := cli.Get(ts.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	rec = recorder.New("testdata/tls")
+	e, ok := rec.Lookup(http.MethodGet, ts.URL)
+	if !ok {
+		t.Fatalf("Entry was not recorded")
+	}
+	if e.Response.TLS == nil {
+		t.Fatalf("TLS information was not recorded")
+	}
+	if !strings.HasPrefix(e.Response.TLS.Version, "TLS 1.") {
+		t.Errorf("TLS version = %q, want TLS 1.x", e.Response.TLS.Version)
+	}
+	if e.Response.TLS.CipherSuite == "" {
+		t.Errorf("TLS cipher suite was not recorded")
+	}
+	if want := "O=Acme Co"; e.Response.TLS.PeerSubject != want {
+		t.Errorf("TLS peer subject = %q, want %q", e.Response.TLS.PeerSubject, want)
+	}
+}
+
+func TestRoundTrip_AtomicWrite(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "hello %s", r.URL.Path)
+	}))
+	defer ts.Close()
+
+	const filename = "testdata/atomic/cassette.yml"
+
+	rec := recorder.New(filename)
+	rec.Mode = recorder.Record
+	cli := &http.Client{Transport: rec}
+
+	var prev os.FileInfo
+	for _, p := range []string{"/a", "/b", "/c"} {
+		if _, err := cli.Get(ts.URL + p); err != nil {
+			t.Fatal(err)
+		}
+		fi, err := os.Stat(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The file is replaced rather than written in place
+		if prev != nil && os.SameFile(prev, fi) {
+			t.Errorf("%s: file was modified in place", p)
+		}
+		prev = fi
+	}
+
+	files, err := ioutil.ReadDir(path.Dir(filename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		var names []string
+		for _, f := range files {
+			names = append(names, f.Name())
+		}
+		t.Errorf("Directory contains %v, want only the cassette", names)
+	}
+
+	saved, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"/a", "/b", "/c"} {
+		if !bytes.Contains(saved, []byte("hello "+p)) {
+			t.Errorf("Saved file does not contain %s\n\n%s", p, saved)
+		}
+	}
+}
+
+func TestRoundTrip_RewriteFile(t *testing.T) {
+	removeRecording(t, "testdata/rewrite")
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "hello %s", r.URL.Path)
+	}))
+	defer ts.Close()
+
+	rec := recorder.New("testdata/rewrite")
+	cli := &http.Client{Transport: rec}
+	for _, p := range []string{"/a", "/b"} {
+		if _, err := cli.Get(ts.URL + p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Record more entries, filtering one of them
+	rec = recorder.New("testdata/rewrite")
+	rec.Skip = func(e *recorder.Entry) bool {
+		return strings.HasSuffix(e.Request.URL, "/c")
+	}
+	cli = &http.Client{Transport: rec}
+	for _, p := range []string{"/a", "/c", "/d"} {
+		if _, err := cli.Get(ts.URL + p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	saved, err := ioutil.ReadFile("testdata/rewrite.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"/a", "/b", "/d"} {
+		if !bytes.Contains(saved, []byte("hello "+p)) {
+			t.Errorf("Saved file does not contain %s\n\n%s", p, saved)
+		}
+	}
+	if bytes.Contains(saved, []byte("hello /c")) {
+		t.Errorf("Saved file contains filtered entry\n\n%s", saved)
+	}
+	if n := bytes.Count(saved, []byte("timestamp: ")); n != 3 {
+		t.Errorf("Saved file contains %d timestamps, want %d\n\n%s", n, 3, saved)
+	}
+
+	// The file matches the entries in memory
+	got := recorder.New("testdata/rewrite").Entries()
+	if diff := cmp.Diff(got, rec.Entries(), cmpopts.EquateEmpty()); diff != "" {
+		t.Errorf("Saved entries do not match (-saved, +memory)\n%s", diff)
+	}
+}
+
+func TestRoundTrip_StreamBody(t *testing.T) {
+	const delay = 50 * time.Millisecond
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i, data := range []string{"a", "b", "c"} {
+			if i > 0 {
+				time.Sleep(delay)
+			}
+			fmt.Fprint(w, data)
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer ts.Close()
+
+	rec := recorder.New("testdata/stream-body")
+	rec.StreamBody = true
+	cli := &http.Client{Transport: rec}
+
+	if _, err := cli.Get(ts.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	e, ok := rec.Lookup(http.MethodGet, ts.URL)
+	if !ok {
+		t.Fatalf("Entry was not recorded")
+	}
+	if e.Response.Body != "abc" {
+		t.Errorf("Body = %q, want %q", e.Response.Body, "abc")
+	}
+	if len(e.Response.Chunks) != 3 {
+		t.Fatalf("Got %d chunks, want %d: %v", len(e.Response.Chunks), 3, e.Response.Chunks)
+	}
+	for i, c := range e.Response.Chunks[1:] {
+		if c.Delay < delay/2 {
+			t.Errorf("Chunk %d: delay = %v, want at least %v", i+1, c.Delay, delay/2)
+		}
+	}
+
+	rec = recorder.New("testdata/stream-body")
+	rec.Mode = recorder.ReplayOnly
+	rec.StreamBody = true
+	cli = &http.Client{Transport: rec}
+
+	start := time.Now()
+	resp, err := cli.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 10)
+	n, err := resp.Body.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "a" {
+		t.Errorf("First read = %q, want %q", buf[:n], "a")
+	}
+	rest, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rest) != "bc" {
+		t.Errorf("Rest of body = %q, want %q", rest, "bc")
+	}
+	if elapsed := time.Since(start); elapsed < delay {
+		t.Errorf("Replayed body in %v, want at least %v", elapsed, delay)
+	}
+}
+
+func TestRoundTrip_RecordOnce(t *testing.T) {
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		fmt.Fprintf(w, "call %d", requests)
+	}))
+	defer ts.Close()
+
+	// Existing entries are not replayed
+	rec := recorder.New("testdata/record-once")
+	rec.Mode = recorder.Record
+	cli := &http.Client{Transport: rec}
+	if _, err := cli.Get(ts.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	rec = recorder.New("testdata/record-once")
+	rec.Mode = recorder.Record
+	rec.RecordOnce = true
+	cli = &http.Client{Transport: rec}
+
+	for i := 0; i < 3; i++ {
+		resp, err := cli.Get(ts.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != "call 2" {
+			t.Errorf("Request %d: body = %q, want %q", i, body, "call 2")
+		}
+	}
+	if requests != 2 {
+		t.Errorf("Got %d outgoing requests, want %d", requests, 2)
+	}
+	if n := len(rec.Entries()); n != 1 {
+		t.Errorf("Got %d entries, want %d", n, 1)
+	}
+}
+
+func TestRoundTrip_ReplayOrRecord(t *testing.T) {
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		b, _ := ioutil.ReadAll(r.Body)
+		fmt.Fprintf(w, "got %s", b)
+	}))
+	defer ts.Close()
+
+	rec := recorder.New("testdata/replay-or-record")
+	rec.Mode = recorder.ReplayOrRecord
+	cli := &http.Client{Transport: rec}
+
+	post := func(path, token, body string) (string, error) {
+		req, _ := http.NewRequest(http.MethodPost, ts.URL+path, strings.NewReader(body))
+		req.Header.Set("X-Token", token)
+		resp, err := cli.Do(req)
+		if err != nil {
+			return "", err
+		}
+		b, err := ioutil.ReadAll(resp.Body)
+		return string(b), err
+	}
+
+	// New endpoint is recorded
+	if _, err := post("/a", "1", "hello"); err != nil {
+		t.Fatal(err)
+	}
+	if requests != 1 {
+		t.Fatalf("Got %d outgoing requests, want %d", requests, 1)
+	}
+
+	// Exact match is replayed
+	body, err := post("/a", "1", "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != "got hello" {
+		t.Errorf("Body = %q, want %q", body, "got hello")
+	}
+	if requests != 1 {
+		t.Errorf("Got %d outgoing requests, want %d", requests, 1)
+	}
+
+	// Changed payload is an error
+	for _, test := range []struct{ Token, Body string }{{"1", "changed"}, {"2", "hello"}} {
+		_, err = post("/a", test.Token, test.Body)
+		uerr, ok := err.(*url.Error)
+		if !ok {
+			t.Fatalf("Returned error is %T, not *url.Error", err)
+		}
+		if _, ok := uerr.Err.(recorder.MismatchError); !ok {
+			t.Errorf("Got error %T %v, want %T", uerr.Err, uerr.Err, recorder.MismatchError{})
+		}
+	}
+	if requests != 1 {
+		t.Errorf("Got %d outgoing requests, want %d", requests, 1)
+	}
+
+	// Another new endpoint is recorded
+	if _, err := post("/b", "1", "hello"); err != nil {
+		t.Fatal(err)
+	}
+	if requests != 2 {
+		t.Errorf("Got %d outgoing requests, want %d", requests, 2)
+	}
+}
+
+func TestEntryTiming(t *testing.T) {
+	removeRecording(t, "testdata/timing")
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+	}))
+	defer ts.Close()
+
+	before := time.Now()
+	rec := recorder.New("testdata/timing")
+	cli := &http.Client{Transport: rec}
+	if _, err := cli.Get(ts.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	e := recorder.New("testdata/timing").Entries()[0]
+	if e.Duration < 20*time.Millisecond {
+		t.Errorf("Duration = %v, want at least %v", e.Duration, 20*time.Millisecond)
+	}
+	if e.Timestamp.Before(before.Add(-time.Second)) || e.Timestamp.After(time.Now()) {
+		t.Errorf("Timestamp = %v, want around %v", e.Timestamp, before)
+	}
+
+	// Timing saved as comments is still read
+	legacy := []byte(`# request 0
+# timestamp 2019-04-30 10:02:04 +0000 UTC
+# roundtrip 398ms
+request:
+  method: GET
+  url: https://example.com
+response:
+  status_code: 200
+`)
+	if err := ioutil.WriteFile("testdata/timing-legacy.yml", legacy, 0644); err != nil {
+		t.Fatal(err)
+	}
+	e = recorder.New("testdata/timing-legacy").Entries()[0]
+	if want := 398 * time.Millisecond; e.Duration != want {
+		t.Errorf("Legacy duration = %v, want %v", e.Duration, want)
+	}
+	if want := time.Date(2019, 4, 30, 10, 2, 4, 0, time.UTC); !e.Timestamp.Equal(want) {
+		t.Errorf("Legacy timestamp = %v, want %v", e.Timestamp, want)
+	}
+
+	// Missing timing is tolerated
+	missing := []byte("request:\n  method: GET\n  url: https://example.com\n")
+	if err := ioutil.WriteFile("testdata/timing-missing.yml", missing, 0644); err != nil {
+		t.Fatal(err)
+	}
+	e = recorder.New("testdata/timing-missing").Entries()[0]
+	if !e.Timestamp.IsZero() || e.Duration != 0 {
+		t.Errorf("Got timing %v, %v for entry without timing", e.Timestamp, e.Duration)
+	}
+}
+
+func TestModeEnv(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("Unexpected request to %s", r.URL)
+	}))
+	defer ts.Close()
+
+	os.Setenv(recorder.ModeEnv, "Replay")
+	defer os.Unsetenv(recorder.ModeEnv)
+
+	rec := recorder.New("testdata/mode-env")
+	cli := &http.Client{Transport: rec}
+	_, err := cli.Get(ts.URL)
+	if uerr, ok := err.(*url.Error); !ok {
+		t.Errorf("Got error %T %v, want %T", err, err, recorder.NoRequestError{})
+	} else if _, ok := uerr.Err.(recorder.NoRequestError); !ok {
+		t.Errorf("Got error %T %v, want %T", uerr.Err, uerr.Err, recorder.NoRequestError{})
+	}
+	if rec.Mode != recorder.ReplayOnly {
+		t.Errorf("Mode = %v, want %v", rec.Mode, recorder.ReplayOnly)
+	}
+
+	os.Setenv(recorder.ModeEnv, "replay-only")
+	invalid := recorder.New("testdata/mode-env")
+	if _, err := invalid.Client().Get(ts.URL); err == nil || !strings.Contains(err.Error(), `invalid mode "replay-only"`) {
+		t.Errorf("Got error %v, want it to mention the invalid mode", err)
+	}
+	if err := invalid.Save(); err == nil {
+		t.Error("Expected error saving with an invalid mode")
+	}
+
+	// Inline fixtures are always replayed
+	os.Setenv(recorder.ModeEnv, "record")
+	inline := recorder.NewReplayOnly(recorder.Entry{
+		Request:  &recorder.Request{Method: "GET", URL: ts.URL + "/inline"},
+		Response: &recorder.Response{StatusCode: 200, Body: "inline"},
+	})
+	if err := inline.Validate(); err != nil {
+		t.Errorf("Validate: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := inline.Client().Get(ts.URL + "/inline"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := inline.Client().Get(ts.URL + "/other"); err == nil {
+		t.Error("Expected error for unrecorded request")
+	}
+	if inline.Mode != recorder.ReplayOnly {
+		t.Errorf("NewReplayOnly: Mode = %v, want %v", inline.Mode, recorder.ReplayOnly)
+	}
+}
+
+func TestParseMode(t *testing.T) {
+	tests := map[string]recorder.Mode{
+		"auto":             recorder.Auto,
+		"replay":           recorder.ReplayOnly,
+		"RECORD":           recorder.Record,
+		" passthrough ":    recorder.Passthrough,
+		"verify":           recorder.Verify,
+		"replay-or-record": recorder.ReplayOrRecord,
+	}
+	for name, want := range tests {
+		got, err := recorder.ParseMode(name)
+		if err != nil {
+			t.Errorf("ParseMode(%q) error: %v", name, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("ParseMode(%q) = %v, want %v", name, got, want)
+		}
+	}
+	if _, err := recorder.ParseMode("foo"); err == nil {
+		t.Error("ParseMode(\"foo\") returned no error")
+	}
+}
+
+func TestWithoutRecording(t *testing.T) {
+	removeRecording(t, "testdata/without-recording")
+
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		fmt.Fprintf(w, "token %d", requests)
+	}))
+	defer ts.Close()
+
+	rec := recorder.New("testdata/without-recording")
+	cli := &http.Client{Transport: rec}
+
+	for i := 1; i <= 2; i++ {
+		req, err := http.NewRequest("GET", ts.URL+"/token", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req = req.WithContext(recorder.WithoutRecording(req.Context()))
+		resp, err := cli.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if want := fmt.Sprintf("token %d", i); string(body) != want {
+			t.Errorf("Body = %q, want %q", body, want)
+		}
+	}
+	if _, err := cli.Get(ts.URL + "/other"); err != nil {
+		t.Fatal(err)
+	}
+
+	if requests != 3 {
+		t.Errorf("Got %d outgoing requests, want %d", requests, 3)
+	}
+	if _, ok := rec.Lookup("GET", ts.URL+"/token"); ok {
+		t.Error("Request without recording was recorded")
+	}
+	entries := recorder.New("testdata/without-recording").Entries()
+	if len(entries) != 1 {
+		t.Errorf("Got %d entries on disk, want 1", len(entries))
+	}
+}
+
+func TestEntryString(t *testing.T) {
+	e := recorder.Entry{
+		Request: &recorder.Request{
+			Method:  "POST",
+			URL:     "https://example.com/users",
+			Headers: map[string]string{"Content-Type": "application/json", "Authorization": "secret"},
+			Body:    `{"name":"test"}`,
+		},
+		Response: &recorder.Response{
+			StatusCode: 201,
+			Headers:    map[string]string{"Content-Type": "application/json", "Location": "/users/1"},
+			Body:       `{"id":1,` + strings.Repeat(" ", 300) + `}`,
+		},
+	}
+	want := `POST https://example.com/users
+  Content-Type: application/json
+  {"name":"test"}
+-> 201 Created
+  Content-Type: application/json
+  Location: /users/1
+  {"id":1,` + strings.Repeat(" ", 192) + `... (309 bytes)`
+	if got := e.String(); got != want {
+		t.Errorf("String() =\n%s\n\nwant\n%s", got, want)
+	}
+
+	e.Response = nil
+	e.Error = "connection refused"
+	want = `POST https://example.com/users
+  Content-Type: application/json
+  {"name":"test"}
+-> error: connection refused`
+	if got := e.String(); got != want {
+		t.Errorf("String() =\n%s\n\nwant\n%s", got, want)
+	}
+}
+
+func TestRoundTrip_Upgrade(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+		brw.WriteString("Upgrade: websocket\r\n")
+		brw.WriteString("Connection: Upgrade\r\n")
+		brw.WriteString("Sec-Websocket-Accept: s3pPLMBiTxaQ9kYGzzhZRbK+xOo=\r\n\r\n")
+		brw.Flush()
+		// Echo a single line after upgrading
+		line, err := brw.ReadString('\n')
+		if err != nil {
+			return
+		}
+		brw.WriteString(line)
+		brw.Flush()
+	}))
+	defer ts.Close()
+
+	newRequest := func() *http.Request {
+		req, err := http.NewRequest("GET", ts.URL+"/ws", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", "websocket")
+		req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+		return req
+	}
+
+	rec := recorder.New("testdata/upgrade")
+	rec.Mode = recorder.Record
+	resp, err := rec.RoundTrip(newRequest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("StatusCode = %d, want %d", resp.StatusCode, http.StatusSwitchingProtocols)
+	}
+	conn, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		t.Fatalf("Body is %T, want the upgraded connection", resp.Body)
+	}
+	if _, err := conn.Write([]byte("hello\n")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 6)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello\n" {
+		t.Errorf("Echo = %q, want %q", buf, "hello\n")
+	}
+	conn.Close()
+
+	// The handshake is replayed
+	rec = recorder.New("testdata/upgrade")
+	rec.Mode = recorder.ReplayOnly
+	resp, err = rec.RoundTrip(newRequest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Errorf("Replayed StatusCode = %d, want %d", resp.StatusCode, http.StatusSwitchingProtocols)
+	}
+	for k, want := range map[string]string{
+		"Upgrade":              "websocket",
+		"Connection":           "Upgrade",
+		"Sec-Websocket-Accept": "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=",
+	} {
+		if got := resp.Header.Get(k); got != want {
+			t.Errorf("Replayed header %s = %q, want %q", k, got, want)
+		}
+	}
+	if resp.Body != http.NoBody {
+		t.Errorf("Replayed body is %T, want http.NoBody", resp.Body)
+	}
+}
+
+func TestRecorderNow(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+
+	clock := time.Date(2019, 5, 1, 12, 0, 0, 0, time.UTC)
+	rec := recorder.New("testdata/now")
+	rec.Now = func() time.Time {
+		clock = clock.Add(100 * time.Millisecond)
+		return clock
+	}
+	if _, err := rec.Client().Get(ts.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	e := recorder.New("testdata/now").Entries()[0]
+	if want := time.Date(2019, 5, 1, 12, 0, 0, 100e6, time.UTC); !e.Timestamp.Equal(want) {
+		t.Errorf("Timestamp = %v, want %v", e.Timestamp, want)
+	}
+	if want := 100 * time.Millisecond; e.Duration != want {
+		t.Errorf("Duration = %v, want %v", e.Duration, want)
+	}
+}
+
+func TestMatchURL(t *testing.T) {
+	removeRecording(t, "testdata/match-url")
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "item %s", r.URL.Query().Get("id"))
+	}))
+	defer ts.Close()
+
+	withoutToken := func(req *http.Request) string {
+		u := *req.URL
+		q := u.Query()
+		q.Del("token")
+		u.RawQuery = q.Encode()
+		return u.String()
+	}
+
+	rec := recorder.New("testdata/match-url")
+	rec.MatchURL = withoutToken
+	if _, err := rec.Client().Get(ts.URL + "/items?id=1&token=abc"); err != nil {
+		t.Fatal(err)
+	}
+
+	rec = recorder.New("testdata/match-url")
+	rec.Mode = recorder.ReplayOnly
+	rec.MatchURL = withoutToken
+	if got, want := rec.Entries()[0].Request.URL, ts.URL+"/items?id=1&token=abc"; got != want {
+		t.Errorf("Saved URL = %q, want %q", got, want)
+	}
+	resp, err := rec.Client().Get(ts.URL + "/items?token=xyz&id=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	if string(body) != "item 1" {
+		t.Errorf("Body = %q, want %q", body, "item 1")
+	}
+	if _, err := rec.Client().Get(ts.URL + "/items?id=2&token=abc"); err == nil {
+		t.Error("Expected error for different id")
+	}
+
+	// The selector takes precedence
+	rec.Selector = recorder.SelectorFunc(func([]recorder.Entry, *http.Request) (recorder.Entry, bool) {
+		return recorder.Entry{}, false
+	})
+	if _, err := rec.Client().Get(ts.URL + "/items?id=1&token=abc"); err == nil {
+		t.Error("Expected error from selector")
+	}
+}
+
+func TestIgnorePathSegments(t *testing.T) {
+	uuid := regexp.MustCompile(`^[0-9a-f]{8}-([0-9a-f]{4}-){3}[0-9a-f]{12}$`)
+	rec := &recorder.Recorder{Mode: recorder.ReplayOnly, IgnorePathSegments: uuid.MatchString}
+	rec.Add(recorder.Entry{
+		Request:  &recorder.Request{Method: "GET", URL: "https://example.com/orders/3fa85f64-5717-4562-b3fc-2c963f66afa6/items?page=1"},
+		Response: &recorder.Response{StatusCode: 200, Body: "items"},
+	})
+	cli := rec.Client()
+
+	testcases := []struct {
+		URL   string
+		Match bool
+	}{
+		{"https://example.com/orders/3fa85f64-5717-4562-b3fc-2c963f66afa6/items?page=1", true},
+		{"https://example.com/orders/7bc2e1d4-0a1b-4c5d-9e8f-123456789abc/items?page=1", true},
+		{"https://example.com/orders/7bc2e1d4-0a1b-4c5d-9e8f-123456789abc/items?page=2", false},
+		{"https://example.com/orders/123/items?page=1", false},
+		{"https://example.com/orders/7bc2e1d4-0a1b-4c5d-9e8f-123456789abc/other?page=1", false},
+		{"https://other.com/orders/7bc2e1d4-0a1b-4c5d-9e8f-123456789abc/items?page=1", false},
+	}
+	for _, test := range testcases {
+		_, err := cli.Get(test.URL)
+		if test.Match && err != nil {
+			t.Errorf("Get(%s): %v", test.URL, err)
+		} else if !test.Match && err == nil {
+			t.Errorf("Get(%s): expected no matching entry", test.URL)
+		}
+	}
+}
+
+func TestDelete(t *testing.T) {
+	removeRecording(t, "testdata/delete")
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer ts.Close()
+
+	rec := recorder.New("testdata/delete")
+	cli := rec.Client()
+	for _, p := range []string{"/a", "/b", "/a?x=1"} {
+		if _, err := cli.Get(ts.URL + p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if !rec.Delete("get", ts.URL+"/a") {
+		t.Error("Delete returned false for recorded entry")
+	}
+	if rec.Delete("GET", ts.URL+"/a") {
+		t.Error("Delete returned true for deleted entry")
+	}
+	if err := rec.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	var urls []string
+	for _, e := range recorder.New("testdata/delete").Entries() {
+		urls = append(urls, e.Request.URL)
+	}
+	if diff := cmp.Diff(urls, []string{ts.URL + "/b", ts.URL + "/a?x=1"}); diff != "" {
+		t.Errorf("Saved entries do not match (-got, +want)\n%s", diff)
+	}
+}
+
+func TestMethodOverrideHeader(t *testing.T) {
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte(r.Header.Get("X-HTTP-Method-Override")))
+	}))
+	defer ts.Close()
+
+	post := func(cli *http.Client, method string) string {
+		req, err := http.NewRequest("POST", ts.URL+"/items/1", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-HTTP-Method-Override", method)
+		resp, err := cli.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(body)
+	}
+
+	rec := recorder.New("testdata/method-override")
+	rec.MethodOverrideHeader = "X-HTTP-Method-Override"
+	cli := rec.Client()
+	for i := 0; i < 2; i++ {
+		for _, method := range []string{"PATCH", "DELETE"} {
+			if got := post(cli, method); got != method {
+				t.Errorf("Body = %q, want %q", got, method)
+			}
+		}
+	}
+	if requests != 2 {
+		t.Errorf("Got %d outgoing requests, want %d", requests, 2)
+	}
+
+	// Recorded with the method that was sent
+	e := rec.Entries()[1]
+	if e.Request.Method != "POST" || e.Request.Header("X-HTTP-Method-Override") != "DELETE" {
+		t.Errorf("Recorded %s with override %q, want POST with DELETE", e.Request.Method, e.Request.Header("X-HTTP-Method-Override"))
+	}
+}
+
+func TestLoadFrom(t *testing.T) {
+	entries, err := recorder.LoadFrom(strings.NewReader(`
+request:
+  method: GET
+  url: https://example.com/a
+response:
+  status_code: 200
+  body: hello
+
+---
+
+request:
+  method: GET
+  url: https://example.com/b
+response:
+  status_code: 404
+`))
+	if err != nil {
+		t.Fatalf("LoadFrom: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Got %d entries, want 2", len(entries))
+	}
+
+	rec := recorder.NewReplayOnly(entries...)
+	resp, err := rec.Client().Get("https://example.com/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "hello" {
+		t.Errorf("Body = %q, want %q", body, "hello")
+	}
+	if _, err := rec.Client().Get("https://example.com/c"); err == nil {
+		t.Error("Expected error for unrecorded request")
+	}
+	if _, err := os.Stat(".yml"); !os.IsNotExist(err) {
+		t.Errorf("Expected no file to be written, got %v", err)
+	}
+
+	if _, err := recorder.LoadFrom(strings.NewReader("request: [")); err == nil {
+		t.Error("Expected error for invalid input")
+	}
+}
+
+func TestPrettyJSON(t *testing.T) {
+	const respBody = `{"id":1,"tags":["a","b"]}` + "\n"
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Write([]byte(respBody))
+	}))
+	defer ts.Close()
+
+	rec := recorder.New("testdata/pretty-json")
+	rec.PrettyJSON = true
+	if _, err := rec.Client().Post(ts.URL, "application/vnd.api+json", strings.NewReader(`{"name":"test"}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	saved, err := ioutil.ReadFile("testdata/pretty-json.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"      \"name\": \"test\"\n", "      \"tags\": [\n        \"a\",\n"} {
+		if !strings.Contains(string(saved), want) {
+			t.Errorf("Saved file does not contain %q\n\n%s", want, saved)
+		}
+	}
+
+	// Replayed bodies are unchanged
+	rec = recorder.New("testdata/pretty-json")
+	rec.PrettyJSON = true
+	rec.Mode = recorder.ReplayOnly
+	rec.BodyMatcher = recorder.ExactBody{}
+	resp, err := rec.Client().Post(ts.URL, "application/vnd.api+json", strings.NewReader(`{"name":"test"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != respBody {
+		t.Errorf("Body = %q, want %q", body, respBody)
+	}
+}
+
+func TestDefaultTransport(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+
+	// The certificate of the test server is not trusted by default
+	rec := recorder.New("testdata/default-transport")
+	rec.Mode = recorder.Passthrough
+	if _, err := rec.Client().Get(ts.URL); err == nil {
+		t.Error("Expected certificate error without DefaultTransport")
+	}
+
+	recorder.DefaultTransport = ts.Client().Transport
+	defer func() { recorder.DefaultTransport = nil }()
+
+	rec = recorder.New("testdata/default-transport")
+	if _, err := rec.Client().Get(ts.URL); err != nil {
+		t.Errorf("Get with DefaultTransport: %v", err)
+	}
+
+	// Transport takes precedence
+	rec = recorder.New("testdata/default-transport")
+	rec.Mode = recorder.Passthrough
+	rec.Transport = &http.Transport{}
+	if _, err := rec.Client().Get(ts.URL); err == nil {
+		t.Error("Expected certificate error with Transport set")
+	}
+}
+
+func TestShouldRecord(t *testing.T) {
+	removeRecording(t, "testdata/should-record")
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/private" {
+			w.Header().Set("Cache-Control", "private, no-store")
+		}
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer ts.Close()
+
+	rec := recorder.New("testdata/should-record")
+	rec.ShouldRecord = func(e *recorder.Entry) bool {
+		return !strings.Contains(e.Response.Header("Cache-Control"), "no-store")
+	}
+	for _, p := range []string{"/public", "/private"} {
+		resp, err := rec.Client().Get(ts.URL + p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != p {
+			t.Errorf("Body = %q, want %q", body, p)
+		}
+	}
+
+	var urls []string
+	for _, e := range recorder.New("testdata/should-record").Entries() {
+		urls = append(urls, e.Request.URL)
+	}
+	if diff := cmp.Diff(urls, []string{ts.URL + "/public"}); diff != "" {
+		t.Errorf("Saved entries do not match (-got, +want)\n%s", diff)
+	}
+	if _, ok := rec.Lookup("GET", ts.URL+"/private"); ok {
+		t.Error("Entry that should not be recorded was kept in memory")
+	}
+}
+
+func TestRecordSampler(t *testing.T) {
+	var calls int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		fmt.Fprintf(w, "%s %d", r.URL.Path, calls)
+	}))
+	defer ts.Close()
+
+	rec := recorder.New("testdata/record-sampler")
+	rec.Mode = recorder.Record
+	rec.RecordSampler = func(method, url string, occurrence int) bool {
+		return occurrence == 1 || occurrence%3 == 0
+	}
+	for i := 0; i < 7; i++ {
+		if _, err := rec.Client().Get(ts.URL + "/poll"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := rec.Client().Get(ts.URL + "/other"); err != nil {
+		t.Fatal(err)
+	}
+
+	var bodies []string
+	for _, e := range recorder.New("testdata/record-sampler").Entries() {
+		bodies = append(bodies, e.Response.Body)
+	}
+	if diff := cmp.Diff(bodies, []string{"/poll 1", "/poll 3", "/poll 6", "/other 8"}); diff != "" {
+		t.Errorf("Saved entries do not match (-got, +want)\n%s", diff)
+	}
+}
+
+func TestRecordSamplerConcurrent(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+
+	removeRecording(t, "testdata/record-sampler-concurrent")
+	rec := recorder.New("testdata/record-sampler-concurrent")
+	rec.Mode = recorder.Record
+	var mu sync.Mutex
+	seen := map[int]bool{}
+	rec.RecordSampler = func(method, url string, occurrence int) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		seen[occurrence] = true
+		return occurrence%2 == 0
+	}
+
+	cli := rec.Client()
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := cli.Get(ts.URL + "/poll")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+		}()
+	}
+	wg.Wait()
+
+	// Every request gets its own occurrence
+	if len(seen) != 20 {
+		t.Errorf("Got %d distinct occurrences, want 20", len(seen))
+	}
+	if n := len(rec.Entries()); n != 10 {
+		t.Errorf("Got %d entries, want 10", n)
+	}
+}
+
+func TestTransferEncoding(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello "))
+		if r.URL.Path == "/chunked" {
+			// Flushing before the handler returns sends the response chunked
+			w.(http.Flusher).Flush()
+		}
+		w.Write([]byte("world"))
+	}))
+	defer ts.Close()
+
+	rec := recorder.New("testdata/transfer-encoding")
+	for _, p := range []string{"/chunked", "/length"} {
+		resp, err := rec.Client().Get(ts.URL + p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	rec = recorder.New("testdata/transfer-encoding")
+	rec.Mode = recorder.ReplayOnly
+	resp, err := rec.Client().Get(ts.URL + "/chunked")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(resp.TransferEncoding, []string{"chunked"}); diff != "" {
+		t.Errorf("TransferEncoding does not match (-got, +want)\n%s", diff)
+	}
+	if resp.ContentLength != -1 {
+		t.Errorf("ContentLength = %d, want -1", resp.ContentLength)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	if string(body) != "hello world" {
+		t.Errorf("Body = %q, want %q", body, "hello world")
+	}
+
+	resp, err = rec.Client().Get(ts.URL + "/length")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.TransferEncoding != nil || resp.ContentLength != 11 {
+		t.Errorf("TransferEncoding = %v, ContentLength = %d, want nil, 11", resp.TransferEncoding, resp.ContentLength)
+	}
+}
+
+func TestBodylessMethods(t *testing.T) {
+	var requests int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		b, _ := ioutil.ReadAll(r.Body)
+		fmt.Fprintf(w, "got %q", b)
+	}))
+	defer ts.Close()
+
+	rec := recorder.New("testdata/bodyless-methods")
+	rec.Mode = recorder.ReplayOrRecord
+	rec.BodylessMethods = recorder.DefaultBodylessMethods
+	send := func(method, body string) string {
+		req, _ := http.NewRequest(method, ts.URL, strings.NewReader(body))
+		resp, err := rec.Client().Do(req)
+		if err != nil {
+			t.Fatalf("%s: %v", method, err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		return string(b)
+	}
+
+	// The body is still sent
+	if got, want := send("GET", "spurious"), `got "spurious"`; got != want {
+		t.Errorf("Body = %q, want %q", got, want)
+	}
+	send("POST", "data")
+	entries := rec.Entries()
+	if got := entries[0].Request.Body; got != "" {
+		t.Errorf("Recorded GET body = %q, want empty", got)
+	}
+	if got := entries[1].Request.Body; got != "data" {
+		t.Errorf("Recorded POST body = %q, want %q", got, "data")
+	}
+
+	// The body is ignored when matching
+	if got, want := send("GET", "other"), `got "spurious"`; got != want {
+		t.Errorf("Replayed body = %q, want %q", got, want)
+	}
+	if requests != 2 {
+		t.Errorf("Got %d outgoing requests, want 2", requests)
+	}
+}
+
+func TestMultipleSetCookie(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "a", Value: "1"})
+		http.SetCookie(w, &http.Cookie{Name: "b", Value: "2"})
+		http.SetCookie(w, &http.Cookie{Name: "c", Value: "3"})
+		w.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+
+	cookies := func(rec *recorder.Recorder) string {
+		jar, _ := cookiejar.New(nil)
+		cli := &http.Client{Transport: rec, Jar: jar}
+		resp, err := cli.Get(ts.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		u, _ := url.Parse(ts.URL)
+		var out []string
+		for _, c := range jar.Cookies(u) {
+			out = append(out, c.String())
+		}
+		return strings.Join(out, "; ")
+	}
+
+	if got, want := cookies(recorder.New("testdata/set-cookie")), "a=1; b=2; c=3"; got != want {
+		t.Errorf("Recorded cookies = %q, want %q", got, want)
+	}
+
+	rec := recorder.New("testdata/set-cookie")
+	rec.Mode = recorder.ReplayOnly
+	if got, want := cookies(rec), "a=1; b=2; c=3"; got != want {
+		t.Errorf("Replayed cookies = %q, want %q", got, want)
+	}
+
+	// Removing the header removes all values
+	rec = recorder.New("testdata/set-cookie-removed", recorder.RemoveResponseHeader("Set-Cookie"))
+	if got := cookies(rec); got != "" {
+		t.Errorf("Cookies = %q, want none", got)
+	}
+	if mh := rec.Entries()[0].Response.MultiHeaders; mh != nil {
+		t.Errorf("MultiHeaders = %v, want nil", mh)
+	}
+}
+
+func TestOrderedHeaders(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("X-B", "1")
+		w.Header().Add("X-A", "2")
+		w.Header().Add("X-B", "3")
+		w.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+
+	const filename = "testdata/ordered-headers.yml"
+	removeRecording(t, "testdata/ordered-headers")
+	rec := recorder.New(filename, recorder.KeepResponseHeaders("X-A", "X-B"))
+	rec.OrderedHeaders = true
+	req, _ := http.NewRequest("GET", ts.URL, nil)
+	req.Header.Set("X-Request", "value")
+	req.Header.Add("X-Repeated", "1")
+	req.Header.Add("X-Repeated", "2")
+	if _, err := rec.Client().Do(req); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Repeated values keep their order, but net/http does not preserve the
+	// order of different headers, so they are sorted by name
+	want := `  header_list:
+  - name: X-A
+    value: "2"
+  - name: X-B
+    value: "1"
+  - name: X-B
+    value: "3"
+`
+	if !strings.Contains(string(b), want) || strings.Contains(string(b), "headers:") {
+		t.Errorf("Saved file does not contain header list\n%s\nwant\n%s", b, want)
+	}
+	wantRequest := `  - name: X-Repeated
+    value: "1"
+  - name: X-Repeated
+    value: "2"
+`
+	if !strings.Contains(string(b), wantRequest) {
+		t.Errorf("Saved file does not contain repeated request header\n%s\nwant\n%s", b, wantRequest)
+	}
+
+	// Files with header lists are loaded without the option
+	rec = recorder.New(filename)
+	rec.Mode = recorder.ReplayOnly
+	e := rec.Entries()[0]
+	if got := e.Request.Header("X-Request"); got != "value" {
+		t.Errorf("Request header = %q, want %q", got, "value")
+	}
+	if diff := cmp.Diff(e.Request.MultiHeaders, map[string][]string{"X-Repeated": {"1", "2"}}); diff != "" {
+		t.Errorf("Request multi headers do not match (-got, +want)\n%s", diff)
+	}
+	resp, err := rec.Client().Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(resp.Header, http.Header{"X-A": {"2"}, "X-B": {"1", "3"}}); diff != "" {
+		t.Errorf("Replayed headers do not match (-got, +want)\n%s", diff)
+	}
+}
+
+func TestHeaderList(t *testing.T) {
+	h := http.Header{"X-B": {"1", "3"}, "X-A": {"2"}}
+	l := recorder.NewHeaderList(h)
+	want := recorder.HeaderList{{Name: "X-A", Value: "2"}, {Name: "X-B", Value: "1"}, {Name: "X-B", Value: "3"}}
+	if diff := cmp.Diff(l, want); diff != "" {
+		t.Errorf("NewHeaderList does not match (-got, +want)\n%s", diff)
+	}
+	if diff := cmp.Diff(l.Header(), h); diff != "" {
+		t.Errorf("Header does not match (-got, +want)\n%s", diff)
+	}
+}
+
+func TestFilenameExtension(t *testing.T) {
+	removeRecording(t, "testdata/ext")
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+
+	testcases := []struct {
+		Filename, Saved string
+	}{
+		{"testdata/ext/none", "testdata/ext/none.yml"},
+		{"testdata/ext/yml.yml", "testdata/ext/yml.yml"},
+		{"testdata/ext/yaml.yaml", "testdata/ext/yaml.yaml"},
+		{"testdata/ext/custom.cassette", "testdata/ext/custom.cassette"},
+		{"testdata/ext/compressed.yaml.gz", "testdata/ext/compressed.yaml.gz"},
+		{"testdata/ext.d/none", "testdata/ext.d/none.yml"},
+	}
+
+	for _, test := range testcases {
+		rec := recorder.New(test.Filename)
+		if _, err := rec.Client().Get(ts.URL); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(test.Saved); err != nil {
+			t.Errorf("%s: %v", test.Filename, err)
+		}
+		if rec.Filename != test.Saved {
+			t.Errorf("%s: Filename = %q, want %q", test.Filename, rec.Filename, test.Saved)
+		}
+
+		// The same file is loaded again
+		if n := len(recorder.New(test.Filename).Entries()); n != 1 {
+			t.Errorf("%s: Loaded %d entries, want 1", test.Filename, n)
+		}
+	}
+
+	// Files saved by older versions with .yml added to dotted names are used
+	const legacy = "testdata/ext/api.example.com"
+	if err := ioutil.WriteFile(legacy+".yml", []byte("request:\n  method: GET\n  url: "+ts.URL+"\nresponse:\n  status_code: 200\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rec := recorder.New(legacy)
+	rec.Mode = recorder.ReplayOnly
+	if _, err := rec.Client().Get(ts.URL); err != nil {
+		t.Errorf("Legacy file: %v", err)
+	}
+	if want := legacy + ".yml"; rec.Filename != want {
+		t.Errorf("Legacy file: Filename = %q, want %q", rec.Filename, want)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	done := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow-body" {
+			w.Write([]byte("partial"))
+			w.(http.Flusher).Flush()
+		}
+		select {
+		case <-done:
+		case <-r.Context().Done():
+		}
+	}))
+	defer ts.Close()
+	defer close(done)
+
+	rec := recorder.New("testdata/timeout")
+	rec.Timeout = 50 * time.Millisecond
+	rec.RecordErrors = true
+	for _, p := range []string{"/slow", "/slow-body"} {
+		start := time.Now()
+		_, err := rec.Client().Get(ts.URL + p)
+		if uerr, ok := err.(*url.Error); !ok || uerr.Err != context.DeadlineExceeded {
+			t.Errorf("%s: Got error %v, want %v", p, err, context.DeadlineExceeded)
+		}
+		if d := time.Since(start); d > time.Second {
+			t.Errorf("%s: Request took %v", p, d)
+		}
+	}
+	if n := len(rec.Entries()); n != 0 {
+		t.Errorf("Got %d entries, want 0", n)
+	}
+}
+
+func TestEntryDeadline(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+
+	removeRecording(t, "testdata/deadline")
+	clock := time.Now().Add(time.Hour)
+	rec := recorder.New("testdata/deadline")
+	rec.Mode = recorder.Record
+	rec.Now = func() time.Time { return clock }
+	rec.Timeout = time.Minute // Not included
+	ctx, cancel := context.WithDeadline(context.Background(), clock.Add(10*time.Second))
+	defer cancel()
+	req, _ := http.NewRequest("GET", ts.URL+"/deadline", nil)
+	if _, err := rec.Client().Do(req.WithContext(ctx)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rec.Client().Get(ts.URL + "/none"); err != nil {
+		t.Fatal(err)
+	}
+
+	entries := rec.Entries()
+	if d := entries[0].Deadline; d != 10*time.Second {
+		t.Errorf("Deadline = %v, want %v", d, 10*time.Second)
+	}
+	if d := entries[1].Deadline; d != 0 {
+		t.Errorf("Deadline without deadline = %v, want 0", d)
+	}
+
+	// The deadline is not used for matching
+	rec = recorder.New("testdata/deadline")
+	rec.Mode = recorder.ReplayOnly
+	if _, err := rec.Client().Get(ts.URL + "/deadline"); err != nil {
+		t.Errorf("Replay: %v", err)
+	}
+}
+
+func TestReplayAndNetworkCount(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+
+	rec := recorder.New("testdata/counts")
+	cli := rec.Client()
+	for i := 0; i < 3; i++ {
+		if _, err := cli.Get(ts.URL + "/a"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := cli.Get(ts.URL + "/b"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := rec.ReplayCount(), 2; got != want {
+		t.Errorf("ReplayCount() = %d, want %d", got, want)
+	}
+	if got, want := rec.NetworkCount(), 2; got != want {
+		t.Errorf("NetworkCount() = %d, want %d", got, want)
+	}
+
+	rec = recorder.New("testdata/counts")
+	rec.Mode = recorder.ReplayOnly
+	for _, p := range []string{"/a", "/b", "/c"} {
+		rec.Client().Get(ts.URL + p) // nolint: errcheck
+	}
+	if got, want := rec.ReplayCount(), 2; got != want {
+		t.Errorf("ReplayOnly: ReplayCount() = %d, want %d", got, want)
+	}
+	if got := rec.NetworkCount(); got != 0 {
+		t.Errorf("ReplayOnly: NetworkCount() = %d, want 0", got)
+	}
+}
+
+func TestAutoConcurrentIdenticalRequests(t *testing.T) {
+	removeRecording(t, "testdata/auto-concurrent")
+
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(10 * time.Millisecond)
+		w.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+
+	rec := recorder.New("testdata/auto-concurrent")
+	cli := rec.Client()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := cli.Get(ts.URL + "/a")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+		}()
+	}
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("Server got %d requests, want 1", n)
+	}
+	if got, want := rec.ReplayCount(), 9; got != want {
+		t.Errorf("ReplayCount() = %d, want %d", got, want)
+	}
+	if n := len(rec.Entries()); n != 1 {
+		t.Errorf("Got %d entries, want 1", n)
+	}
+}
+
+func TestConcurrentAccessors(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer ts.Close()
+
+	removeRecording(t, "testdata/concurrent-accessors")
+	rec := recorder.New("testdata/concurrent-accessors")
+	defer rec.Close()
+	cli := rec.Client()
+	extra := recorder.Entry{
+		Request:  &recorder.Request{Method: "GET", URL: ts.URL + "/extra"},
+		Response: &recorder.Response{StatusCode: 200, Body: "extra"},
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		p := fmt.Sprintf("/%d", i)
+		go func() {
+			defer wg.Done()
+			resp, err := cli.Get(ts.URL + p)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+		}()
+		go func() {
+			defer wg.Done()
+			rec.Lookup("GET", ts.URL+p)
+			rec.Entries()
+			rec.Add(extra)
+			rec.Delete("GET", ts.URL+"/extra")
+			rec.ReRecord("GET", ts.URL+p)
+			if err := rec.Merge([]recorder.Entry{extra}); err != nil {
+				t.Error(err)
+			}
+			if err := rec.Save(); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for i := 0; i < 10; i++ {
+		if _, ok := rec.Lookup("GET", fmt.Sprintf("%s/%d", ts.URL, i)); !ok {
+			t.Errorf("Entry for /%d not found", i)
+		}
+	}
+}
+
+func TestAutoConcurrentDifferentRequests(t *testing.T) {
+	slow := make(chan struct{})
+	release := make(chan struct{})
+	var rec *recorder.Recorder
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/slow":
+			close(slow)
+			<-release
+		case "/nested":
+			// Requests through the same recorder from a handler don't block
+			resp, err := rec.Client().Get("http://" + r.Host + "/fast")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			io.Copy(w, resp.Body) // nolint: errcheck
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+
+	removeRecording(t, "testdata/auto-concurrent-different")
+	rec = recorder.New("testdata/auto-concurrent-different")
+	if _, err := rec.Client().Get(ts.URL + "/fast"); err != nil {
+		t.Fatal(err)
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := rec.Client().Get(ts.URL + "/slow")
+		errc <- err
+	}()
+	<-slow
+
+	// Replays and other misses are not blocked by the request in flight
+	if _, err := rec.Client().Get(ts.URL + "/fast"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rec.Client().Get(ts.URL + "/nested"); err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if got, want := rec.ReplayCount(), 2; got != want {
+		t.Errorf("ReplayCount() = %d, want %d", got, want)
+	}
+}
+
+func TestRequestAndResponseBytes(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("response"))
+	}))
+	defer ts.Close()
+
+	rec := recorder.New("testdata/bytes")
+	for i := 0; i < 2; i++ {
+		// The second request is replayed
+		resp, err := rec.Client().Post(ts.URL, "text/plain", strings.NewReader("request"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	if got, want := rec.RequestBytes(), int64(2*len("request")); got != want {
+		t.Errorf("RequestBytes() = %d, want %d", got, want)
+	}
+	if got, want := rec.ResponseBytes(), int64(2*len("response")); got != want {
+		t.Errorf("ResponseBytes() = %d, want %d", got, want)
+	}
+}
+
+func TestObservedRequests(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+
+	rec := recorder.New("testdata/observed")
+	cli := rec.Client()
+	for i := 0; i < 2; i++ {
+		// The second request is replayed
+		resp, err := cli.Post(ts.URL+"/login?b=2&a=1", "text/plain", strings.NewReader("secret"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	if _, err := cli.Get(ts.URL + "/items"); err != nil {
+		t.Fatal(err)
+	}
+
+	got := rec.ObservedRequests()
+	if len(got) != 3 {
+		t.Fatalf("Observed %d requests, want 3", len(got))
+	}
+	if got[1].Body != "secret" {
+		t.Errorf("Replayed request body = %q, want %q", got[1].Body, "secret")
+	}
+
+	login := recorder.Request{Method: "POST", URL: ts.URL + "/login?a=1&b=2", Body: "secret"}
+	items := recorder.Request{Method: "get", URL: ts.URL + "/items"}
+	if err := rec.VerifyRequests(login, login, items); err != nil {
+		t.Errorf("VerifyRequests: %v", err)
+	}
+	if err := rec.VerifyRequests(login, login); err == nil {
+		t.Error("Expected error for unexpected request")
+	}
+	if err := rec.VerifyRequests(login, login, items, items); err == nil {
+		t.Error("Expected error for missing request")
+	}
+	if err := rec.VerifyRequests(login, items, items); err == nil {
+		t.Error("Expected error for different request")
+	}
+	wrongBody := login
+	wrongBody.Body = "other"
+	if err := rec.VerifyRequests(wrongBody, login, items); err == nil {
+		t.Error("Expected error for different body")
+	}
+
+	rec.ResetObservedRequests()
+	if n := len(rec.ObservedRequests()); n != 0 {
+		t.Errorf("Observed %d requests after reset, want 0", n)
+	}
+	if _, err := cli.Get(ts.URL + "/items"); err != nil {
+		t.Fatal(err)
+	}
+	if err := rec.VerifyRequests(items); err != nil {
+		t.Errorf("VerifyRequests after reset: %v", err)
+	}
+}
+
+func TestRoundTrip_NoContentType(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Prevent the server from sniffing the content type
+		w.Header()["Content-Type"] = nil
+		w.Write([]byte("<html>not sniffed</html>"))
+	}))
+	defer ts.Close()
+
+	rec := recorder.New("testdata/no-content-type")
+	if _, err := rec.Client().Get(ts.URL); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := rec.Entries()[0].Response.Headers["Content-Type"]; ok {
+		t.Errorf("Recorded Content-Type %q, want none", v)
+	}
+
+	rec = recorder.New("testdata/no-content-type")
+	rec.Mode = recorder.ReplayOnly
+	resp, err := rec.Client().Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := resp.Header["Content-Type"]; ok {
+		t.Errorf("Replayed Content-Type %q, want none", v)
+	}
+	for k := range resp.Header {
+		if _, ok := rec.Entries()[0].Response.Headers[k]; !ok {
+			t.Errorf("Replayed header %s that was not recorded", k)
+		}
+	}
+}
+
+func TestEntryDelay(t *testing.T) {
+	entries, err := recorder.LoadFrom(strings.NewReader(`
+request:
+  method: GET
+  url: https://example.com/slow
+response:
+  status_code: 200
+delay: 100ms
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries[0].Delay != 100*time.Millisecond {
+		t.Fatalf("Delay = %v, want %v", entries[0].Delay, 100*time.Millisecond)
+	}
+	rec := recorder.NewReplayOnly(entries...)
+
+	start := time.Now()
+	if _, err := rec.Client().Get("https://example.com/slow"); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 100*time.Millisecond {
+		t.Errorf("Response returned after %v, want at least %v", d, 100*time.Millisecond)
+	}
+
+	// The delay respects the context
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequest("GET", "https://example.com/slow", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start = time.Now()
+	_, err = rec.Client().Do(req.WithContext(ctx))
+	if uerr, ok := err.(*url.Error); !ok || uerr.Err != context.DeadlineExceeded {
+		t.Errorf("Got error %v, want %v", err, context.DeadlineExceeded)
+	}
+	if d := time.Since(start); d >= 100*time.Millisecond {
+		t.Errorf("Canceled request returned after %v", d)
+	}
+}
+
+func TestRecordHosts(t *testing.T) {
+	removeRecording(t, "testdata/record-hosts")
+
+	newServer := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name))
+		}))
+	}
+	api := newServer("api")
+	defer api.Close()
+	local := newServer("local")
+	defer local.Close()
+	other := newServer("other")
+	defer other.Close()
+
+	host := func(ts *httptest.Server) string { return strings.TrimPrefix(ts.URL, "http://") }
+
+	rec := recorder.New("testdata/record-hosts")
+	rec.RecordHosts = []string{host(api), host(local)}
+	rec.PassthroughHosts = []string{host(local)}
+	for _, ts := range []*httptest.Server{api, local, other} {
+		if _, err := rec.Client().Get(ts.URL); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var urls []string
+	for _, e := range rec.Entries() {
+		urls = append(urls, e.Request.URL)
+	}
+	if diff := cmp.Diff(urls, []string{api.URL}); diff != "" {
+		t.Errorf("Recorded entries do not match (-got, +want)\n%s", diff)
+	}
+
+	// Passthrough hosts are not replayed
+	rec = recorder.New("testdata/record-hosts")
+	rec.Mode = recorder.ReplayOnly
+	rec.PassthroughHosts = []string{"127.0.0.1"}
+	if _, err := rec.Client().Get(local.URL); err != nil {
+		t.Errorf("Get passthrough host: %v", err)
+	}
+	if n := rec.NetworkCount(); n != 1 {
+		t.Errorf("NetworkCount() = %d, want 1", n)
+	}
+}
+
+func TestPassthroughFunc(t *testing.T) {
+	removeRecording(t, "testdata/passthrough-func")
+
+	var calls int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		fmt.Fprintf(w, "call %d", calls)
+	}))
+	defer ts.Close()
+
+	rec := recorder.New("testdata/passthrough-func")
+	rec.Passthrough = func(req *http.Request) bool {
+		return req.Header.Get("Cache-Control") == "no-cache"
+	}
+	get := func(noCache bool) string {
+		req, _ := http.NewRequest("GET", ts.URL, nil)
+		if noCache {
+			req.Header.Set("Cache-Control", "no-cache")
+		}
+		resp, err := rec.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return string(body)
+	}
+
+	var got []string
+	for _, noCache := range []bool{false, true, false, true} {
+		got = append(got, get(noCache))
+	}
+	// The first response is recorded and replayed, the others are live
+	if diff := cmp.Diff(got, []string{"call 1", "call 2", "call 1", "call 3"}); diff != "" {
+		t.Errorf("Responses do not match (-got, +want)\n%s", diff)
+	}
+	if n := len(rec.Entries()); n != 1 {
+		t.Errorf("Got %d recorded entries, want 1", n)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		rec  *recorder.Recorder
+		env  string
+		err  string
+	}{
+		{"new", recorder.New("testdata/validate"), "", ""},
+		{"in memory", &recorder.Recorder{Mode: recorder.Record}, "", ""},
+		{"mode", &recorder.Recorder{Mode: recorder.ReplayOrRecord + 1}, "", "unsupported mode 6"},
+		{"negative mode", &recorder.Recorder{Mode: -1}, "", "unsupported mode -1"},
+		{"env", recorder.New("testdata/validate"), "invalid", "RECORDER_MODE: "},
+		{"body file without filename", &recorder.Recorder{BodyFileThreshold: 1024}, "", "BodyFileThreshold requires a Filename"},
+		{"negative timeout", &recorder.Recorder{Timeout: -time.Second}, "", "negative Timeout -1s"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv(recorder.ModeEnv, tt.env)
+			defer os.Unsetenv(recorder.ModeEnv)
+
+			err := tt.rec.Validate()
+			if tt.err == "" {
+				if err != nil {
+					t.Errorf("Validate() = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("Validate() = %v, want error containing %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestQueryOrder(t *testing.T) {
+	removeRecording(t, "testdata/query-order")
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.RawQuery))
+	}))
+	defer ts.Close()
+
+	rec := recorder.New("testdata/query-order")
+	if _, err := rec.Client().Get(ts.URL + "/search?q=go&tag=b&page=2&tag=a"); err != nil {
+		t.Fatal(err)
+	}
+	// Parameters with the same name keep their order
+	if got, want := rec.Entries()[0].Request.URL, ts.URL+"/search?page=2&q=go&tag=b&tag=a"; got != want {
+		t.Errorf("Saved URL = %q, want %q", got, want)
+	}
+
+	rec = recorder.New("testdata/query-order")
+	rec.Mode = recorder.ReplayOnly
+	for _, query := range []string{"tag=b&tag=a&q=go&page=2", "page=2&tag=b&q=go&tag=a"} {
+		resp, err := rec.Client().Get(ts.URL + "/search?" + query)
+		if err != nil {
+			t.Errorf("Get %s: %v", query, err)
+			continue
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		if want := "q=go&tag=b&page=2&tag=a"; string(body) != want {
+			t.Errorf("Body = %q, want %q", body, want)
+		}
+	}
+	if _, err := rec.Client().Get(ts.URL + "/search?q=go&tag=a&page=2&tag=b"); err == nil {
+		t.Error("Expected error for different order of repeated parameters")
+	}
+	if _, ok := rec.Lookup("GET", ts.URL+"/search?tag=b&q=go&tag=a&page=2"); !ok {
+		t.Error("Lookup did not find entry with different query order")
+	}
+}
+
+func TestReRecord(t *testing.T) {
+	removeRecording(t, "testdata/rerecord")
+
+	var calls int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		fmt.Fprintf(w, "%s %d", r.URL.Path, calls)
+	}))
+	defer ts.Close()
+
+	rec := recorder.New("testdata/rerecord")
+	for _, p := range []string{"/a", "/b", "/c"} {
+		if _, err := rec.Client().Get(ts.URL + p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rec = recorder.New("testdata/rerecord")
+	if rec.ReRecord("GET", ts.URL+"/missing") {
+		t.Error("ReRecord returned true for missing entry")
+	}
+	if !rec.ReRecord("GET", ts.URL+"/b") {
+		t.Fatal("ReRecord returned false")
+	}
+	get := func(p string) string {
+		resp, err := rec.Client().Get(ts.URL + p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		return string(body)
+	}
+	// Only the first matching request is sent
+	for i := 0; i < 2; i++ {
+		if got, want := get("/b"), "/b 4"; got != want {
+			t.Errorf("Body = %q, want %q", got, want)
+		}
+	}
+	if got, want := get("/a"), "/a 1"; got != want {
+		t.Errorf("Body = %q, want %q", got, want)
+	}
+
+	var bodies []string
+	for _, e := range recorder.New("testdata/rerecord").Entries() {
+		bodies = append(bodies, e.Response.Body)
+	}
+	if diff := cmp.Diff(bodies, []string{"/a 1", "/b 4", "/c 3"}); diff != "" {
+		t.Errorf("Saved entries do not match (-got, +want)\n%s", diff)
+	}
+}
+
+func TestIgnoreHeaders(t *testing.T) {
+	var requests int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+
+	rec := recorder.New("testdata/ignore-headers")
+	rec.Mode = recorder.ReplayOrRecord
+	rec.IgnoreHeaders = []string{"user-agent"}
+	get := func(userAgent, token string) error {
+		req, _ := http.NewRequest("GET", ts.URL, nil)
+		req.Header.Set("User-Agent", userAgent)
+		req.Header.Set("X-Token", token)
+		_, err := rec.Client().Do(req)
+		return err
+	}
+
+	if err := get("Go-http-client/1.1", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if got := rec.Entries()[0].Request.Header("User-Agent"); got != "Go-http-client/1.1" {
+		t.Errorf("Recorded User-Agent = %q, want %q", got, "Go-http-client/1.1")
+	}
+	if err := get("Go-http-client/2.0", "1"); err != nil {
+		t.Errorf("Request with other User-Agent: %v", err)
+	}
+	if requests != 1 {
+		t.Errorf("Got %d outgoing requests, want 1", requests)
+	}
+	err := get("Go-http-client/2.0", "2")
+	if !errors.As(err, &recorder.MismatchError{}) {
+		t.Errorf("Error = %v, want MismatchError", err)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	removeRecording(t, "testdata/merge")
+
+	const filename = "testdata/merge.yml"
+	entry := func(path, body string) recorder.Entry {
+		return recorder.Entry{
+			Request:  &recorder.Request{Method: "GET", URL: "https://example.com" + path},
+			Response: &recorder.Response{StatusCode: 200, Body: body},
+		}
+	}
+	rec := recorder.New(filename)
+	rec.Add(entry("/a", "a"), entry("/b", "b 1"), entry("/b", "b 2"), entry("/c", "c"))
+	if err := rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	rec = recorder.New(filename)
+	if err := rec.Merge([]recorder.Entry{entry("/b", "b 3"), entry("/d", "d"), entry("/b", "b 4"), entry("/b", "b 5")}); err != nil {
+		t.Fatal(err)
+	}
+
+	var bodies []string
+	for _, e := range recorder.New(filename).Entries() {
+		bodies = append(bodies, e.Response.Body)
+	}
+	if diff := cmp.Diff(bodies, []string{"a", "b 3", "b 4", "c", "d", "b 5"}); diff != "" {
+		t.Errorf("Saved entries do not match (-got, +want)\n%s", diff)
+	}
+}
+
+func TestErrNoRequest(t *testing.T) {
+	rec := recorder.NewReplayOnly()
+	_, err := rec.Client().Get("https://example.com/missing")
+	if !errors.Is(err, recorder.ErrNoRequest) {
+		t.Errorf("errors.Is(%v, ErrNoRequest) = false, want true", err)
+	}
+	var nerr recorder.NoRequestError
+	if !errors.As(err, &nerr) {
+		t.Fatalf("errors.As(%v, NoRequestError) = false, want true", err)
+	}
+	if got, want := nerr.Request.URL.String(), "https://example.com/missing"; got != want {
+		t.Errorf("Request URL = %q, want %q", got, want)
+	}
+	if errors.Is(errors.New("no recorded entry"), recorder.ErrNoRequest) {
+		t.Error("Unrelated error matches ErrNoRequest")
+	}
+}
+
+func TestReplayEntryWithoutResponse(t *testing.T) {
+	rec := recorder.NewReplayOnly(recorder.Entry{
+		Request: &recorder.Request{Method: "GET", URL: "https://example.com/incomplete"},
+	})
+	_, err := rec.Client().Get("https://example.com/incomplete")
+	if err == nil || !strings.Contains(err.Error(), "has no response") {
+		t.Errorf("Got error %v, want entry without response", err)
+	}
+}
+
+func TestCollapseRedirects(t *testing.T) {
+	removeRecording(t, "testdata/collapse-redirects")
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/start":
+			http.Redirect(w, r, "/login", http.StatusFound)
+		case "/login":
+			http.Redirect(w, r, "/final", http.StatusTemporaryRedirect)
+		default:
+			b, _ := ioutil.ReadAll(r.Body)
+			fmt.Fprintf(w, "%s %s %s", r.Method, r.URL.Path, b)
+		}
+	}))
+	defer ts.Close()
+
+	rec := recorder.New("testdata/collapse-redirects")
+	rec.CollapseRedirects = true
+	resp, err := rec.Client().Get(ts.URL + "/start")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "GET /final "; string(body) != want {
+		t.Errorf("Body = %q, want %q", body, want)
+	}
+
+	// The body is sent again for 307
+	resp, err = rec.Client().Post(ts.URL+"/login", "text/plain", strings.NewReader("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "POST /final data"; string(body) != want {
+		t.Errorf("Body = %q, want %q", body, want)
+	}
+
+	var urls []string
+	for _, e := range recorder.New("testdata/collapse-redirects").Entries() {
+		urls = append(urls, e.Request.URL)
+	}
+	if diff := cmp.Diff(urls, []string{ts.URL + "/start", ts.URL + "/login"}); diff != "" {
+		t.Errorf("Recorded entries do not match (-got, +want)\n%s", diff)
+	}
+
+	// The final response is replayed for the original URL
+	rec = recorder.New("testdata/collapse-redirects")
+	rec.Mode = recorder.ReplayOnly
+	resp, err = rec.Client().Get(ts.URL + "/start")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "GET /final "; string(body) != want {
+		t.Errorf("Replayed body = %q, want %q", body, want)
+	}
+}
+
+func TestClose(t *testing.T) {
+	removeRecording(t, "testdata/close")
+
+	const filename = "testdata/close.yml"
+
+	rec := recorder.New(filename)
+	if err := rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		t.Errorf("Close without changes wrote file: %v", err)
+	}
+
+	rec.Add(recorder.Entry{
+		Request:  &recorder.Request{Method: "GET", URL: "https://example.com"},
+		Response: &recorder.Response{StatusCode: 200},
+	})
+	for i := 0; i < 2; i++ {
+		if err := rec.Close(); err != nil {
+			t.Fatalf("Close %d: %v", i, err)
+		}
+	}
+	if n := len(recorder.New(filename).Entries()); n != 1 {
+		t.Errorf("Got %d saved entries, want 1", n)
+	}
+
+	if !rec.Delete("GET", "https://example.com") {
+		t.Fatal("Delete returned false")
+	}
+	if err := rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(recorder.New(filename).Entries()); n != 0 {
+		t.Errorf("Got %d saved entries after delete, want 0", n)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer ts.Close()
+
+	const filename = "testdata/dry-run.yml"
+	var written []byte
+	rec := recorder.New(filename, recorder.RemoveRequestHeader("Authorization"))
+	rec.DryRun = true
+	rec.OnWrite = func(data []byte) { written = data }
+
+	req, _ := http.NewRequest("GET", ts.URL, nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := rec.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if err := rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		t.Errorf("DryRun wrote file: %v", err)
+	}
+	if n := len(rec.Entries()); n != 1 {
+		t.Errorf("Got %d entries, want 1", n)
+	}
+	if !strings.Contains(string(written), "hello") {
+		t.Errorf("OnWrite data does not contain response body:\n%s", written)
+	}
+	if strings.Contains(string(written), "secret") {
+		t.Errorf("OnWrite data contains filtered header:\n%s", written)
+	}
+}
+
+func TestRecordHeadLargeContentLength(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "4000000000")
+	}))
+	defer ts.Close()
+
+	rec := recorder.New("")
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	if _, err := rec.Client().Head(ts.URL); err != nil {
+		t.Fatal(err)
+	}
+	runtime.ReadMemStats(&after)
+	if n := after.TotalAlloc - before.TotalAlloc; n > 10<<20 {
+		t.Errorf("Recording allocated %d bytes", n)
+	}
+}
+
+func BenchmarkRecordLargeResponse(b *testing.B) {
+	body := bytes.Repeat([]byte("0123456789abcdef"), 1<<20/16*8) // 8 MiB
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/length" {
+			w.Header().Set("Content-Length", fmt.Sprint(len(body)))
+		}
+		w.Write(body)
+	}))
+	defer ts.Close()
+
+	for _, path := range []string{"/length", "/chunked"} {
+		b.Run(path[1:], func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(body)))
+			for i := 0; i < b.N; i++ {
+				rec := &recorder.Recorder{Mode: recorder.Record}
+				resp, err := rec.Client().Get(ts.URL + path)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := io.Copy(ioutil.Discard, resp.Body); err != nil {
+					b.Fatal(err)
+				}
+				resp.Body.Close()
+			}
+		})
+	}
+}
+
+func TestBodyFileThreshold(t *testing.T) {
+	removeRecording(t, "testdata/body-file")
+
+	const filename = "testdata/body-file.yml"
+	large := strings.Repeat("x", 100)
+
+	rec := recorder.New(filename)
+	rec.BodyFileThreshold = 10
+	rec.Add(
+		recorder.Entry{
+			Request:  &recorder.Request{Method: "GET", URL: "https://example.com/small"},
+			Response: &recorder.Response{StatusCode: 200, Body: "small"},
+		},
+		recorder.Entry{
+			Request:  &recorder.Request{Method: "GET", URL: "https://example.com/large"},
+			Response: &recorder.Response{StatusCode: 200, Body: large},
+		},
+	)
+	if err := rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), large) || !strings.Contains(string(b), "body_file: body-file.1.body") {
+		t.Errorf("Large body is not stored separately:\n%s", b)
+	}
+	body, err := ioutil.ReadFile("testdata/body-file.1.body")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != large {
+		t.Errorf("Body file = %q, want %q", body, large)
+	}
+
+	rec = recorder.New(filename)
+	e, ok := rec.Lookup("GET", "https://example.com/large")
+	if !ok {
+		t.Fatal("Entry not found")
+	}
+	if e.Response.Body != large || e.Response.BodyFile != "" {
+		t.Errorf("Loaded response = %+v", e.Response)
+	}
+
+	// Removing the entry removes the body file
+	rec.Delete("GET", "https://example.com/large")
+	if err := rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat("testdata/body-file.1.body"); !os.IsNotExist(err) {
+		t.Errorf("Body file was not removed: %v", err)
+	}
+}
+
+func TestWriter(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer ts.Close()
+
+	var buf bytes.Buffer
+	rec := &recorder.Recorder{Mode: recorder.Record, Writer: &buf}
+	for i := 0; i < 2; i++ {
+		resp, err := rec.Client().Get(ts.URL + fmt.Sprintf("/%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	if buf.Len() != 0 {
+		t.Errorf("Entries written before Close:\n%s", buf.String())
+	}
+	if err := rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := recorder.LoadFrom(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Got %d entries, want 2", len(entries))
+	}
+	if got, want := entries[1].Request.URL, ts.URL+"/1"; got != want {
+		t.Errorf("URL = %q, want %q", got, want)
+	}
+	if got, want := entries[1].Response.Body, "hello"; got != want {
+		t.Errorf("Body = %q, want %q", got, want)
+	}
+
+	// Nothing has changed since the last write
+	if err := rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("Second Close wrote entries again:\n%s", buf.String())
+	}
+}
+
+func TestWriterSaveThenClose(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer ts.Close()
+
+	for _, codec := range []recorder.Codec{recorder.YAMLCodec{}, recorder.JSONLCodec{}} {
+		t.Run(fmt.Sprintf("%T", codec), func(t *testing.T) {
+			var buf bytes.Buffer
+			rec := &recorder.Recorder{Mode: recorder.Record, Writer: &buf, Codec: codec}
+			get := func(p string) {
+				resp, err := rec.Client().Get(ts.URL + p)
+				if err != nil {
+					t.Fatal(err)
+				}
+				resp.Body.Close()
+			}
+			get("/a")
+			if err := rec.Save(); err != nil {
+				t.Fatal(err)
+			}
+			get("/b")
+			if err := rec.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			entries, err := codec.Decode(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var bodies []string
+			for _, e := range entries {
+				bodies = append(bodies, e.Response.Body)
+			}
+			if diff := cmp.Diff(bodies, []string{"/a", "/b"}); diff != "" {
+				t.Errorf("Written entries do not match (-got, +want)\n%s", diff)
+			}
+		})
+	}
+
+	// Codecs that cannot append return an error instead of duplicating entries
+	var buf bytes.Buffer
+	rec := &recorder.Recorder{Mode: recorder.Record, Writer: &buf, Codec: recorder.GobCodec{}}
+	rec.Add(recorder.Entry{Request: &recorder.Request{Method: "GET", URL: ts.URL}})
+	if err := rec.Save(); err != nil {
+		t.Fatal(err)
+	}
+	rec.Add(recorder.Entry{Request: &recorder.Request{Method: "GET", URL: ts.URL + "/b"}})
+	if err := rec.Close(); err == nil {
+		t.Error("Expected error appending gob entries")
+	}
+}
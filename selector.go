@@ -0,0 +1,940 @@
+package recorder
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"math/rand"
+	"mime"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Selector chooses a recorded Entry to response to a given request.
+type Selector interface {
+	Select(entries []Entry, req *http.Request) (Entry, bool)
+}
+
+// The SelectorFunc type is an adapter to allow the use of ordinary functions
+// as selectors.
+type SelectorFunc func(entries []Entry, req *http.Request) (Entry, bool)
+
+// Select implements Selector and calls f(entries, req).
+func (f SelectorFunc) Select(entries []Entry, req *http.Request) (Entry, bool) {
+	return f(entries, req)
+}
+
+// OncePerCall is a Selector that selects entries based on the method and URL,
+// but it will only select any given entry at most once.
+type OncePerCall struct {
+	mu   sync.Mutex
+	used map[int]bool
+}
+
+// Select implements Selector and chooses an entry.
+func (s *OncePerCall) Select(entries []Entry, req *http.Request) (Entry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.used == nil {
+		s.used = map[int]bool{}
+	}
+	for i, e := range entries {
+		if !strings.EqualFold(e.Request.Method, req.Method) {
+			continue
+		} else if !equalURL(e.Request.URL, req.URL.String()) {
+			continue
+		}
+		if !s.used[i] {
+			s.used[i] = true
+			return e, true
+		}
+	}
+	return Entry{}, false
+}
+
+// Sequential is a Selector that selects entries based on the method and URL,
+// returning matching entries in the order they were recorded. Each call for
+// the same method and URL returns the next matching entry.
+//
+// Once all matching entries have been returned, no entry is selected unless
+// RepeatLast is set, in which case the last matching entry is returned for
+// all subsequent calls.
+type Sequential struct {
+	// RepeatLast keeps returning the last matching entry once all matching
+	// entries have been returned.
+	RepeatLast bool
+
+	mu    sync.Mutex
+	calls map[string]int
+}
+
+// Select implements Selector and chooses an entry.
+func (s *Sequential) Select(entries []Entry, req *http.Request) (Entry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.calls == nil {
+		s.calls = map[string]int{}
+	}
+	var matches []Entry
+	for _, e := range entries {
+		if matchMethodURL(e, req) {
+			matches = append(matches, e)
+		}
+	}
+	if len(matches) == 0 {
+		return Entry{}, false
+	}
+	key := strings.ToUpper(req.Method) + " " + strings.ToLower(canonicalURL(req.URL.String()))
+	n := s.calls[key]
+	s.calls[key]++
+	if n < len(matches) {
+		return matches[n], true
+	}
+	if s.RepeatLast {
+		return matches[len(matches)-1], true
+	}
+	return Entry{}, false
+}
+
+// InOrder is a Selector that requires requests to be sent in the order they
+// were recorded. Each request must match the method and URL of the next
+// recorded entry, which is then consumed. Otherwise no entry is selected, and
+// the NoRequestError returned in ReplayOnly mode describes the expected
+// request. This catches changes to the order of calls to stateful APIs.
+type InOrder struct {
+	mu   sync.Mutex
+	next int
+	why  string
+}
+
+// Select implements Selector and chooses an entry.
+func (s *InOrder) Select(entries []Entry, req *http.Request) (Entry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.next >= len(entries) {
+		s.why = fmt.Sprintf("all %d recorded entries have been used, got %s %s", len(entries), req.Method, req.URL)
+		return Entry{}, false
+	}
+	e := entries[s.next]
+	if !matchMethodURL(e, req) {
+		s.why = fmt.Sprintf("expected request %d to be %s %s, got %s %s", s.next, e.Request.Method, e.Request.URL, req.Method, req.URL)
+		return Entry{}, false
+	}
+	s.next++
+	s.why = ""
+	return e, true
+}
+
+// reason returns why the last call to Select did not select an entry.
+func (s *InOrder) reason() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.why
+}
+
+// Playlist is a Selector that returns the recorded entries in order, one per
+// request, regardless of the method and URL of the request. Once all entries
+// have been returned, no entry is selected. This is useful for replaying a
+// fixed sequence of responses to a client without asserting on its requests.
+type Playlist struct {
+	mu   sync.Mutex
+	next int
+}
+
+// Select implements Selector and chooses an entry.
+func (s *Playlist) Select(entries []Entry, req *http.Request) (Entry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.next >= len(entries) {
+		return Entry{}, false
+	}
+	e := entries[s.next]
+	s.next++
+	return e, true
+}
+
+// reason returns why the last call to Select did not select an entry.
+func (s *Playlist) reason() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return fmt.Sprintf("all %d entries of the playlist have been used", s.next)
+}
+
+// RoundRobin is a Selector that selects entries based on the method and URL,
+// cycling through the matching entries in the order they were recorded. After
+// the last matching entry, the first one is returned again. This is useful
+// for replaying responses from a load balanced service, where subsequent
+// calls are handled by different nodes.
+type RoundRobin struct {
+	mu    sync.Mutex
+	calls map[string]int
+}
+
+// Select implements Selector and chooses an entry.
+func (s *RoundRobin) Select(entries []Entry, req *http.Request) (Entry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.calls == nil {
+		s.calls = map[string]int{}
+	}
+	var matches []Entry
+	for _, e := range entries {
+		if matchMethodURL(e, req) {
+			matches = append(matches, e)
+		}
+	}
+	if len(matches) == 0 {
+		return Entry{}, false
+	}
+	key := strings.ToUpper(req.Method) + " " + strings.ToLower(canonicalURL(req.URL.String()))
+	n := s.calls[key]
+	s.calls[key]++
+	return matches[n%len(matches)], true
+}
+
+// RandomAmongMatches is a Selector that selects a random entry among the
+// entries with a matching method and URL. Combined with RecordVariants, this
+// allows replaying endpoints that return one of several responses at random.
+type RandomAmongMatches struct {
+	// Rand is the source of randomness. If nil, the default source of
+	// math/rand is used. Set it to a seeded source for reproducible tests:
+	//
+	//     rec.Selector = &recorder.RandomAmongMatches{Rand: rand.New(rand.NewSource(1))}
+	Rand *rand.Rand
+
+	mu sync.Mutex
+}
+
+// Select implements Selector and chooses an entry.
+func (s *RandomAmongMatches) Select(entries []Entry, req *http.Request) (Entry, bool) {
+	var matches []Entry
+	for _, e := range entries {
+		if matchMethodURL(e, req) {
+			matches = append(matches, e)
+		}
+	}
+	if len(matches) == 0 {
+		return Entry{}, false
+	}
+	if s.Rand == nil {
+		return matches[rand.Intn(len(matches))], true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return matches[s.Rand.Intn(len(matches))], true
+}
+
+// AuthHandshake is a Selector for multi step authentication handshakes, such
+// as NTLM or Negotiate (SPNEGO), where the same URL is requested several times
+// with different Authorization headers before the real response is returned.
+//
+// Among entries with a matching method and URL, an entry with the same
+// Authorization header as the request is selected. As the tokens typically
+// differ between runs, entries are otherwise matched by the step of the
+// handshake: the authentication scheme, and for NTLM the message type. If
+// the same step was recorded several times, the entries are returned in the
+// order they were recorded, repeating the last one.
+type AuthHandshake struct {
+	mu    sync.Mutex
+	calls map[string]int
+}
+
+// Select implements Selector and chooses an entry.
+func (s *AuthHandshake) Select(entries []Entry, req *http.Request) (Entry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.calls == nil {
+		s.calls = map[string]int{}
+	}
+	auth := req.Header.Get("Authorization")
+	step := authStep(auth)
+	var matches []Entry
+	for _, e := range entries {
+		if !matchMethodURL(e, req) {
+			continue
+		}
+		recorded := e.Request.Header("Authorization")
+		if recorded == auth {
+			return e, true
+		}
+		if authStep(recorded) == step {
+			matches = append(matches, e)
+		}
+	}
+	if len(matches) == 0 {
+		return Entry{}, false
+	}
+	key := strings.ToUpper(req.Method) + " " + strings.ToLower(canonicalURL(req.URL.String())) + " " + step
+	n := s.calls[key]
+	s.calls[key]++
+	if n >= len(matches) {
+		n = len(matches) - 1
+	}
+	return matches[n], true
+}
+
+// authStep returns the step of an authentication handshake the Authorization
+// header belongs to.
+func authStep(auth string) string {
+	if auth == "" {
+		return ""
+	}
+	parts := strings.SplitN(auth, " ", 2)
+	scheme := strings.ToLower(parts[0])
+	if len(parts) < 2 || (scheme != "ntlm" && scheme != "negotiate") {
+		return scheme
+	}
+	// NTLM messages start with NTLMSSP\0 and a little-endian message type.
+	// Negotiate may wrap NTLM as well.
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(parts[1]))
+	if err != nil || len(b) < 12 || string(b[:8]) != "NTLMSSP\x00" {
+		return scheme
+	}
+	return fmt.Sprintf("%s %d", scheme, binary.LittleEndian.Uint32(b[8:12]))
+}
+
+// Latest is a Selector that selects the most recently recorded entry with a
+// matching method and URL, as given by Timestamp. If several entries have the
+// same timestamp, or none is set, the last one in the file is selected. This
+// is the inverse of the default selection, which picks the first matching
+// entry.
+type Latest struct{}
+
+// Select implements Selector and chooses an entry.
+func (Latest) Select(entries []Entry, req *http.Request) (Entry, bool) {
+	found := -1
+	for i, e := range entries {
+		if !matchMethodURL(e, req) {
+			continue
+		}
+		if found < 0 || !e.Timestamp.Before(entries[found].Timestamp) {
+			found = i
+		}
+	}
+	if found < 0 {
+		return Entry{}, false
+	}
+	return entries[found], true
+}
+
+// IgnoreHost is a Selector that selects the first entry with a matching
+// method, path and query. The scheme, host and port are ignored. This allows
+// replaying entries recorded against a test server on a random port.
+type IgnoreHost struct{}
+
+// Select implements Selector and chooses an entry.
+func (IgnoreHost) Select(entries []Entry, req *http.Request) (Entry, bool) {
+	uri := req.URL.RequestURI()
+	for _, e := range entries {
+		if !strings.EqualFold(e.Request.Method, req.Method) {
+			continue
+		}
+		u, err := url.Parse(e.Request.URL)
+		if err != nil {
+			continue
+		}
+		if equalURL(u.RequestURI(), uri) {
+			return e, true
+		}
+	}
+	return Entry{}, false
+}
+
+// FormSelector is a Selector that selects entries based on the method, URL
+// and body. If the request is form-encoded, the bodies are compared as form
+// values, ignoring the order of fields. Repeated fields must contain the same
+// values. Other bodies must match exactly.
+type FormSelector struct{}
+
+// Select implements Selector and chooses an entry.
+func (FormSelector) Select(entries []Entry, req *http.Request) (Entry, bool) {
+	body := readBody(req)
+	form := isForm(req.Header.Get("Content-Type"))
+	for _, e := range entries {
+		if !matchMethodURL(e, req) {
+			continue
+		}
+		if form {
+			if equalForm(e.Request.Body, string(body)) {
+				return e, true
+			}
+		} else if e.Request.Body == string(body) {
+			return e, true
+		}
+	}
+	return Entry{}, false
+}
+
+// AcceptSelector is a Selector for content negotiation. Among the entries with
+// a matching method and URL, it selects the one with the response Content-Type
+// the Accept header of the request prefers most, taking quality values into
+// account:
+//
+//     Accept: application/xml;q=0.9, application/json
+//
+// Ties are broken by the order the entries were recorded in. If the request
+// has no Accept header, the first entry is selected. Entries with a content
+// type that is not accepted are never selected.
+type AcceptSelector struct{}
+
+// Select implements Selector and chooses an entry.
+func (AcceptSelector) Select(entries []Entry, req *http.Request) (Entry, bool) {
+	accept := parseAccept(req.Header.Get("Accept"))
+	var best Entry
+	bestQ := 0.0
+	for _, e := range entries {
+		if !matchMethodURL(e, req) {
+			continue
+		}
+		var contentType string
+		if e.Response != nil {
+			contentType = e.Response.Header("Content-Type")
+		}
+		if q := acceptQuality(accept, contentType); q > bestQ {
+			best, bestQ = e, q
+		}
+	}
+	return best, bestQ > 0
+}
+
+type mediaRange struct {
+	typ, subtype string
+	q            float64
+}
+
+// parseAccept parses the media ranges of an Accept header. An empty header
+// accepts everything.
+func parseAccept(header string) []mediaRange {
+	if strings.TrimSpace(header) == "" {
+		return []mediaRange{{"*", "*", 1}}
+	}
+	var ranges []mediaRange
+	for _, part := range strings.Split(header, ",") {
+		mt, params, err := mime.ParseMediaType(part)
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		typ, subtype := splitMediaType(mt)
+		ranges = append(ranges, mediaRange{typ, subtype, q})
+	}
+	return ranges
+}
+
+// acceptQuality returns the quality of the content type according to the
+// most specific matching media range, or 0 if it is not accepted.
+func acceptQuality(accept []mediaRange, contentType string) float64 {
+	typ, subtype := "", ""
+	if mt, _, err := mime.ParseMediaType(contentType); err == nil {
+		typ, subtype = splitMediaType(mt)
+	}
+	q, specificity := 0.0, -1
+	for _, r := range accept {
+		var s int
+		switch {
+		case r.typ == typ && r.subtype == subtype:
+			s = 2
+		case r.typ == typ && r.subtype == "*":
+			s = 1
+		case r.typ == "*" && r.subtype == "*":
+			s = 0
+		default:
+			continue
+		}
+		if s > specificity {
+			q, specificity = r.q, s
+		}
+	}
+	return q
+}
+
+func splitMediaType(mt string) (string, string) {
+	if i := strings.IndexByte(mt, '/'); i >= 0 {
+		return mt[:i], mt[i+1:]
+	}
+	return mt, ""
+}
+
+// HeaderSelector returns a Selector that selects the first entry with a
+// matching method and the same values for the given headers as the request.
+// The URL is ignored. Header names are canonicalized on both sides, so they
+// match regardless of capitalization, and values are compared with
+// surrounding whitespace trimmed.
+func HeaderSelector(names ...string) Selector {
+	return SelectorFunc(func(entries []Entry, req *http.Request) (Entry, bool) {
+		for _, e := range entries {
+			if !strings.EqualFold(e.Request.Method, req.Method) {
+				continue
+			}
+			if matchHeaders(e.Request.Headers, req.Header, names) {
+				return e, true
+			}
+		}
+		return Entry{}, false
+	})
+}
+
+// matchHeaders reports whether the recorded and live headers have the same
+// values for all given names.
+func matchHeaders(recorded map[string]string, live http.Header, names []string) bool {
+	for _, name := range names {
+		want, ok := lookupHeader(recorded, name)
+		if !ok {
+			return false
+		}
+		if strings.TrimSpace(want) != strings.TrimSpace(liveHeader(live, name)) {
+			return false
+		}
+	}
+	return true
+}
+
+// liveHeader returns the first value of the named header. Unlike Get, it also
+// finds headers that were added to the map without canonicalizing the name.
+func liveHeader(h http.Header, name string) string {
+	if vv, ok := h[textproto.CanonicalMIMEHeaderKey(name)]; ok && len(vv) > 0 {
+		return vv[0]
+	}
+	for k, vv := range h {
+		if strings.EqualFold(k, name) && len(vv) > 0 {
+			return vv[0]
+		}
+	}
+	return ""
+}
+
+// GraphQLSelector returns a Selector for GraphQL APIs, where all requests are
+// sent to the same URL. It selects the first entry with a matching method
+// and URL that has the same operationName in its JSON body as the request.
+// If matchVariables is set, the variables must be equal too, ignoring the
+// order of fields:
+//
+//     rec.Selector = recorder.GraphQLSelector(true)
+//
+// Requests that do not have a JSON body with an operationName are never
+// matched.
+func GraphQLSelector(matchVariables bool) Selector {
+	return SelectorFunc(func(entries []Entry, req *http.Request) (Entry, bool) {
+		op, ok := parseGraphQL(readBody(req))
+		if !ok {
+			return Entry{}, false
+		}
+		for _, e := range entries {
+			if !matchMethodURL(e, req) {
+				continue
+			}
+			rop, ok := parseGraphQL([]byte(e.Request.Body))
+			if !ok || rop.OperationName != op.OperationName {
+				continue
+			}
+			if matchVariables && !reflect.DeepEqual(rop.Variables, op.Variables) {
+				continue
+			}
+			return e, true
+		}
+		return Entry{}, false
+	})
+}
+
+type graphQLRequest struct {
+	OperationName string      `json:"operationName"`
+	Variables     interface{} `json:"variables"`
+}
+
+// parseGraphQL parses a GraphQL request body. Returns false if the body is
+// not JSON or does not have an operation name.
+func parseGraphQL(body []byte) (graphQLRequest, bool) {
+	var op graphQLRequest
+	if err := json.Unmarshal(body, &op); err != nil {
+		return op, false
+	}
+	return op, op.OperationName != ""
+}
+
+// FingerprintSelector returns a Selector that selects the first entry with the
+// same fingerprint as the request. The incoming function computes the
+// fingerprint of the request and recorded the fingerprint of a recorded
+// request. This allows expressing arbitrary matching rules in one place:
+//
+//     sel := recorder.FingerprintSelector(
+//         func(r *http.Request) string { return r.Method + " " + r.URL.Path + " " + r.Header.Get("X-Tenant") },
+//         func(r *recorder.Request) string { u, _ := url.Parse(r.URL); return r.Method + " " + u.Path + " " + r.Header("X-Tenant") },
+//     )
+//
+// The body of the request is set to a copy before calling incoming, so it may
+// be read by the function.
+func FingerprintSelector(incoming func(*http.Request) string, recorded func(*Request) string) Selector {
+	return SelectorFunc(func(entries []Entry, req *http.Request) (Entry, bool) {
+		body := readBody(req)
+		key := incoming(req)
+		if req.Body != nil {
+			req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+		for _, e := range entries {
+			if recorded(e.Request) == key {
+				return e, true
+			}
+		}
+		return Entry{}, false
+	})
+}
+
+// BestMatch is a Selector that scores the entries with a matching method and
+// URL by how many of the configured criteria they satisfy, and selects the
+// one with the highest score. Ties are broken by the order the entries were
+// recorded in. Unlike the default selection, an entry is selected even if it
+// does not satisfy all criteria:
+//
+//     rec.Selector = recorder.BestMatch{
+//         Headers: []string{"Accept", "X-Tenant"},
+//         Body:    recorder.JSONBody{},
+//     }
+type BestMatch struct {
+	// Headers lists the request headers to compare. Each header with the
+	// same value, ignoring surrounding whitespace, adds one to the score.
+	Headers []string
+
+	// Body compares request bodies if set. A matching body adds one to the
+	// score.
+	Body BodyMatcher
+
+	// MatchHost adds one to the score if the Host of the request matches the
+	// recorded Host.
+	MatchHost bool
+}
+
+// Select implements Selector and chooses an entry.
+func (s BestMatch) Select(entries []Entry, req *http.Request) (Entry, bool) {
+	var body []byte
+	if s.Body != nil {
+		body = readBody(req)
+	}
+	best, bestScore := -1, -1
+	for i, e := range entries {
+		if score := s.Score(e, req, body); score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+	if best < 0 {
+		return Entry{}, false
+	}
+	return entries[best], true
+}
+
+// Score returns the number of criteria the entry satisfies for the request
+// with the given body, or -1 if the method or URL do not match. This allows
+// custom selectors to reuse the scoring.
+func (s BestMatch) Score(e Entry, req *http.Request, body []byte) int {
+	if !matchMethodURL(e, req) {
+		return -1
+	}
+	score := 0
+	for _, name := range s.Headers {
+		if matchHeaders(e.Request.Headers, req.Header, []string{name}) {
+			score++
+		}
+	}
+	if s.Body != nil && matchBody(e.Request, body, s.Body) {
+		score++
+	}
+	if s.MatchHost {
+		host := req.Host
+		if host == "" {
+			host = req.URL.Host
+		}
+		if strings.EqualFold(e.Request.host(), host) {
+			score++
+		}
+	}
+	return score
+}
+
+// DebugSelector returns a Selector that logs the decisions of the inner
+// selector with logf, such as t.Logf. For each request it logs the entries
+// with the same method and URL that were candidates, and which entry was
+// selected, if any. If inner is nil, the first entry with a matching method
+// and URL is selected, like in the default selection.
+func DebugSelector(inner Selector, logf func(format string, args ...interface{})) Selector {
+	return SelectorFunc(func(entries []Entry, req *http.Request) (Entry, bool) {
+		var candidates []int
+		for i, e := range entries {
+			if matchMethodURL(e, req) {
+				candidates = append(candidates, i)
+			}
+		}
+		logf("recorder: select %s %s: %d of %d entries have the same method and url %v", req.Method, req.URL, len(candidates), len(entries), candidates)
+
+		var e Entry
+		var ok bool
+		if inner != nil {
+			e, ok = inner.Select(entries, req)
+		} else if len(candidates) > 0 {
+			e, ok = entries[candidates[0]], true
+		}
+		if !ok {
+			logf("recorder: select %s %s: no entry selected", req.Method, req.URL)
+			return e, ok
+		}
+		for i := range entries {
+			if entries[i].Request == e.Request {
+				logf("recorder: select %s %s: selected entry %d (%s %s)", req.Method, req.URL, i, e.Request.Method, e.Request.URL)
+				return e, ok
+			}
+		}
+		logf("recorder: select %s %s: selected %s %s", req.Method, req.URL, e.Request.Method, e.Request.URL)
+		return e, ok
+	})
+}
+
+// All returns a Selector that selects the first entry that is selected by all
+// of the selectors. This allows building precise matching from smaller
+// selectors:
+//
+//     rec.Selector = recorder.All(
+//         recorder.HeaderSelector("X-Tenant"),
+//         recorder.GraphQLSelector(true),
+//     )
+//
+// Each entry is offered to the selectors on its own, in the order they were
+// recorded, so the selectors don't have to agree on which entry they would
+// select first among all entries. An entry is only selected if every selector
+// accepts it. Stateful selectors such as Sequential are called once for each
+// entry and should not be used with All. All without selectors never selects
+// an entry.
+func All(selectors ...Selector) Selector {
+	return SelectorFunc(func(entries []Entry, req *http.Request) (Entry, bool) {
+		if len(selectors) == 0 {
+			return Entry{}, false
+		}
+	outer:
+		for i := range entries {
+			for _, s := range selectors {
+				if e, ok := s.Select(entries[i:i+1], req); !ok || e.Request != entries[i].Request {
+					continue outer
+				}
+			}
+			return entries[i], true
+		}
+		return Entry{}, false
+	})
+}
+
+// Any returns a Selector that tries the selectors in order and returns the
+// entry selected by the first one that selects an entry. This allows falling
+// back to looser matching when a strict selector does not find an entry:
+//
+//     rec.Selector = recorder.Any(recorder.HeaderSelector("X-Tenant"), recorder.IgnoreHost{})
+func Any(selectors ...Selector) Selector {
+	return SelectorFunc(func(entries []Entry, req *http.Request) (Entry, bool) {
+		for _, s := range selectors {
+			if e, ok := s.Select(entries, req); ok {
+				return e, true
+			}
+		}
+		return Entry{}, false
+	})
+}
+
+// A BodyMatcher compares the body of a recorded request to the body of an
+// incoming request.
+type BodyMatcher interface {
+	MatchBody(recorded, incoming []byte) bool
+}
+
+// ExactBody is a BodyMatcher that requires the bodies to be identical.
+type ExactBody struct{}
+
+// MatchBody implements BodyMatcher.
+func (ExactBody) MatchBody(recorded, incoming []byte) bool {
+	return bytes.Equal(recorded, incoming)
+}
+
+// JSONBody is a BodyMatcher that compares JSON bodies structurally, ignoring
+// formatting and the order of object keys. Numbers are compared by value, so
+// 1, 1.0 and 1e0 are equal, without losing precision for large integers.
+// Bodies that are not valid JSON must be identical.
+type JSONBody struct{}
+
+// MatchBody implements BodyMatcher.
+func (JSONBody) MatchBody(recorded, incoming []byte) bool {
+	a, erra := decodeJSON(recorded)
+	b, errb := decodeJSON(incoming)
+	if erra != nil || errb != nil {
+		return bytes.Equal(recorded, incoming)
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// jsonNumber is a number in a decoded JSON value, formatted as an exact
+// fraction so equal numbers compare equal regardless of their formatting.
+type jsonNumber string
+
+// decodeJSON decodes a JSON value with the numbers replaced by jsonNumbers.
+func decodeJSON(data []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("invalid data after top-level value")
+	}
+	return normalizeJSON(v), nil
+}
+
+func normalizeJSON(v interface{}) interface{} {
+	switch vv := v.(type) {
+	case json.Number:
+		if r, ok := new(big.Rat).SetString(string(vv)); ok {
+			return jsonNumber(r.RatString())
+		}
+		return jsonNumber(vv)
+	case map[string]interface{}:
+		for k, x := range vv {
+			vv[k] = normalizeJSON(x)
+		}
+	case []interface{}:
+		for i, x := range vv {
+			vv[i] = normalizeJSON(x)
+		}
+	}
+	return v
+}
+
+// MatchJSONFields returns a BodyMatcher that only compares the given fields of
+// JSON bodies, ignoring all other fields. This allows matching bodies that
+// contain volatile values such as timestamps or generated ids.
+//
+// Fields are specified as paths with the keys separated by dots. Array
+// elements are specified by their index:
+//
+//     rec.BodyMatcher = recorder.MatchJSONFields("user.id", "items.0.sku")
+//
+// A field that is missing from both bodies is considered equal. Bodies that
+// are not valid JSON must be identical.
+func MatchJSONFields(paths ...string) BodyMatcher {
+	return jsonFields(paths)
+}
+
+type jsonFields []string
+
+// MatchBody implements BodyMatcher.
+func (f jsonFields) MatchBody(recorded, incoming []byte) bool {
+	a, erra := decodeJSON(recorded)
+	b, errb := decodeJSON(incoming)
+	if erra != nil || errb != nil {
+		return bytes.Equal(recorded, incoming)
+	}
+	for _, p := range f {
+		va, oka := jsonPath(a, p)
+		vb, okb := jsonPath(b, p)
+		if oka != okb || !reflect.DeepEqual(va, vb) {
+			return false
+		}
+	}
+	return true
+}
+
+// jsonPath returns the value at the dot separated path in v.
+func jsonPath(v interface{}, path string) (interface{}, bool) {
+	for _, key := range strings.Split(path, ".") {
+		switch vv := v.(type) {
+		case map[string]interface{}:
+			var ok bool
+			if v, ok = vv[key]; !ok {
+				return nil, false
+			}
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(vv) {
+				return nil, false
+			}
+			v = vv[i]
+		default:
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// FormBody is a BodyMatcher that compares form-encoded bodies, ignoring the
+// order of fields. Repeated fields must contain the same values. Bodies that
+// are not valid form values must be identical.
+type FormBody struct{}
+
+// MatchBody implements BodyMatcher.
+func (FormBody) MatchBody(recorded, incoming []byte) bool {
+	if _, err := url.ParseQuery(string(recorded)); err != nil {
+		return bytes.Equal(recorded, incoming)
+	}
+	return equalForm(string(recorded), string(incoming))
+}
+
+func matchMethodURL(e Entry, req *http.Request) bool {
+	return strings.EqualFold(e.Request.Method, req.Method) &&
+		equalURL(e.Request.URL, req.URL.String())
+}
+
+// readBody reads the body of the request and replaces it with a copy so it
+// can be read again.
+func readBody(req *http.Request) []byte {
+	if req.Body == nil {
+		return nil
+	}
+	b, _ := ioutil.ReadAll(req.Body)
+	req.Body = ioutil.NopCloser(bytes.NewReader(b))
+	return b
+}
+
+func isForm(contentType string) bool {
+	mt, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mt == "application/x-www-form-urlencoded"
+}
+
+func equalForm(a, b string) bool {
+	va, err := url.ParseQuery(a)
+	if err != nil {
+		return false
+	}
+	vb, err := url.ParseQuery(b)
+	if err != nil {
+		return false
+	}
+	if len(va) != len(vb) {
+		return false
+	}
+	for k, xs := range va {
+		ys, ok := vb[k]
+		if !ok || len(xs) != len(ys) {
+			return false
+		}
+		xs = append([]string(nil), xs...)
+		ys = append([]string(nil), ys...)
+		sort.Strings(xs)
+		sort.Strings(ys)
+		for i := range xs {
+			if xs[i] != ys[i] {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,921 @@
+package recorder_test
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/akupila/recorder"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestFormSelector(t *testing.T) {
+	entries := []recorder.Entry{
+		{
+			Request:  &recorder.Request{Method: "POST", URL: "http://foo.com/form", Body: "a=1&b=2&b=3"},
+			Response: &recorder.Response{Body: "1"},
+		},
+		{
+			Request:  &recorder.Request{Method: "POST", URL: "http://foo.com/form", Body: "a=2"},
+			Response: &recorder.Response{Body: "2"},
+		},
+		{
+			Request:  &recorder.Request{Method: "POST", URL: "http://foo.com/raw", Body: "a=1&b=2"},
+			Response: &recorder.Response{Body: "raw"},
+		},
+	}
+
+	testcases := []struct {
+		ContentType, URL, Body, ExpectedBody string
+	}{
+		{"application/x-www-form-urlencoded", "http://foo.com/form", "a=1&b=2&b=3", "1"},
+		{"application/x-www-form-urlencoded", "http://foo.com/form", "b=3&a=1&b=2", "1"},
+		{"application/x-www-form-urlencoded; charset=utf-8", "http://foo.com/form", "a=2", "2"},
+		{"application/x-www-form-urlencoded", "http://foo.com/form", "a=1&b=2", ""}, // missing repeated field
+		{"application/x-www-form-urlencoded", "http://foo.com/form", "a=3", ""},
+		{"text/plain", "http://foo.com/raw", "a=1&b=2", "raw"},
+		{"text/plain", "http://foo.com/raw", "b=2&a=1", ""}, // not form-encoded
+	}
+
+	var sel recorder.FormSelector
+
+	for _, test := range testcases {
+		req := httptest.NewRequest(http.MethodPost, test.URL, strings.NewReader(test.Body))
+		req.Header.Set("Content-Type", test.ContentType)
+		e, ok := sel.Select(entries, req)
+		if test.ExpectedBody == "" { // nolint: gocritic
+			if ok {
+				t.Errorf("%s: Expected no matching entry, but got %v", test.Body, e)
+			}
+		} else if !ok {
+			t.Errorf("%s: Expected a matching entry, but didn't get one", test.Body)
+		} else if e.Response.Body != test.ExpectedBody {
+			t.Errorf("%s: Entry mismatch. Expected body %q, but got %q",
+				test.Body, test.ExpectedBody, e.Response.Body)
+		}
+	}
+}
+
+func TestSequential(t *testing.T) {
+	entries := []recorder.Entry{
+		{
+			Request:  &recorder.Request{Method: "GET", URL: "http://foo.com/job"},
+			Response: &recorder.Response{Body: "pending"},
+		},
+		{
+			Request:  &recorder.Request{Method: "GET", URL: "http://foo.com/other"},
+			Response: &recorder.Response{Body: "other"},
+		},
+		{
+			Request:  &recorder.Request{Method: "GET", URL: "http://foo.com/job"},
+			Response: &recorder.Response{Body: "done"},
+		},
+	}
+
+	testcases := []struct {
+		RepeatLast bool
+		Expected   []string
+	}{
+		{false, []string{"pending", "done", "", ""}},
+		{true, []string{"pending", "done", "done", "done"}},
+	}
+
+	for _, test := range testcases {
+		sel := &recorder.Sequential{RepeatLast: test.RepeatLast}
+		for i, want := range test.Expected {
+			e, ok := sel.Select(entries, httptest.NewRequest("GET", "http://foo.com/job", nil))
+			if want == "" { // nolint: gocritic
+				if ok {
+					t.Errorf("RepeatLast=%t, call %d: Expected no matching entry, but got %v", test.RepeatLast, i, e)
+				}
+			} else if !ok {
+				t.Errorf("RepeatLast=%t, call %d: Expected a matching entry, but didn't get one", test.RepeatLast, i)
+			} else if e.Response.Body != want {
+				t.Errorf("RepeatLast=%t, call %d: Expected body %q, but got %q", test.RepeatLast, i, want, e.Response.Body)
+			}
+		}
+
+		// Other endpoints are tracked separately
+		e, ok := sel.Select(entries, httptest.NewRequest("GET", "http://foo.com/other", nil))
+		if !ok || e.Response.Body != "other" {
+			t.Errorf("RepeatLast=%t: Expected other entry, got %v, %t", test.RepeatLast, e, ok)
+		}
+	}
+}
+
+func TestInOrder(t *testing.T) {
+	var entries []recorder.Entry
+	for _, p := range []string{"/login", "/items", "/logout"} {
+		entries = append(entries, recorder.Entry{
+			Request:  &recorder.Request{Method: "POST", URL: "http://foo.com" + p},
+			Response: &recorder.Response{StatusCode: 200, Body: p},
+		})
+	}
+
+	rec := recorder.NewReplayOnly(entries...)
+	rec.Selector = &recorder.InOrder{}
+	cli := rec.Client()
+
+	if _, err := cli.Post("http://foo.com/login", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	_, err := cli.Post("http://foo.com/logout", "", nil)
+	if err == nil {
+		t.Fatal("Expected error for request out of order")
+	}
+	if want := "expected request 1 to be POST http://foo.com/items, got POST http://foo.com/logout"; !strings.Contains(err.Error(), want) {
+		t.Errorf("Error = %q, want it to contain %q", err, want)
+	}
+	for _, p := range []string{"/items", "/logout"} {
+		if _, err := cli.Post("http://foo.com"+p, "", nil); err != nil {
+			t.Errorf("POST %s: %v", p, err)
+		}
+	}
+	_, err = cli.Post("http://foo.com/login", "", nil)
+	if want := "all 3 recorded entries have been used"; err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("Error = %v, want it to contain %q", err, want)
+	}
+}
+
+func TestPlaylist(t *testing.T) {
+	var entries []recorder.Entry
+	for _, body := range []string{"first", "second"} {
+		entries = append(entries, recorder.Entry{
+			Request:  &recorder.Request{Method: "GET", URL: "http://foo.com/" + body},
+			Response: &recorder.Response{StatusCode: 200, Body: body},
+		})
+	}
+
+	rec := recorder.NewReplayOnly(entries...)
+	rec.Selector = &recorder.Playlist{}
+	cli := rec.Client()
+
+	// The method and URL are ignored
+	for _, want := range []string{"first", "second"} {
+		resp, err := cli.Post("http://bar.com/other", "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		if string(body) != want {
+			t.Errorf("Body = %q, want %q", body, want)
+		}
+	}
+	_, err := cli.Get("http://foo.com/first")
+	if want := "all 2 entries of the playlist have been used"; err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("Error = %v, want it to contain %q", err, want)
+	}
+}
+
+func TestRoundRobin(t *testing.T) {
+	entries := []recorder.Entry{
+		{
+			Request:  &recorder.Request{Method: "GET", URL: "http://foo.com/node"},
+			Response: &recorder.Response{Body: "node-1"},
+		},
+		{
+			Request:  &recorder.Request{Method: "GET", URL: "http://foo.com/other"},
+			Response: &recorder.Response{Body: "other"},
+		},
+		{
+			Request:  &recorder.Request{Method: "GET", URL: "http://foo.com/node"},
+			Response: &recorder.Response{Body: "node-2"},
+		},
+		{
+			Request:  &recorder.Request{Method: "GET", URL: "http://foo.com/node"},
+			Response: &recorder.Response{Body: "node-3"},
+		},
+	}
+
+	sel := &recorder.RoundRobin{}
+	var got []string
+	for i := 0; i < 7; i++ {
+		e, ok := sel.Select(entries, httptest.NewRequest("GET", "http://foo.com/node", nil))
+		if !ok {
+			t.Fatalf("Call %d: Expected a matching entry, but didn't get one", i)
+		}
+		got = append(got, e.Response.Body)
+	}
+	want := []string{"node-1", "node-2", "node-3", "node-1", "node-2", "node-3", "node-1"}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("Selected entries do not match (-got, +want)\n%s", diff)
+	}
+
+	// Other endpoints are tracked separately
+	e, ok := sel.Select(entries, httptest.NewRequest("GET", "http://foo.com/other", nil))
+	if !ok || e.Response.Body != "other" {
+		t.Errorf("Expected other entry, got %v, %t", e, ok)
+	}
+
+	if _, ok := sel.Select(entries, httptest.NewRequest("GET", "http://foo.com/missing", nil)); ok {
+		t.Error("Expected no matching entry for unrecorded URL")
+	}
+}
+
+func TestRandomAmongMatches(t *testing.T) {
+	removeRecording(t, "testdata/random-among-matches")
+
+	variants := []string{"a", "b", "a", "b", "c", "a"}
+	var n int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "variant %s", variants[n%len(variants)])
+		n++
+	}))
+	defer ts.Close()
+
+	// Variants are kept between recorders
+	for i := 0; i < 2; i++ {
+		rec := recorder.New("testdata/random-among-matches")
+		rec.Mode = recorder.Record
+		rec.RecordVariants = true
+		for j := 0; j < 3; j++ {
+			if _, err := rec.Client().Get(ts.URL + "/ab-test"); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	rec := recorder.New("testdata/random-among-matches")
+	rec.Mode = recorder.ReplayOnly
+	rec.Selector = &recorder.RandomAmongMatches{Rand: rand.New(rand.NewSource(1))}
+	var recorded []string
+	for _, e := range rec.Entries() {
+		recorded = append(recorded, e.Response.Body)
+	}
+	if diff := cmp.Diff(recorded, []string{"variant a", "variant b", "variant c"}); diff != "" {
+		t.Errorf("Recorded variants do not match (-got, +want)\n%s", diff)
+	}
+
+	seen := map[string]int{}
+	for i := 0; i < 50; i++ {
+		resp, err := rec.Client().Get(ts.URL + "/ab-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		seen[string(body)]++
+	}
+	if len(seen) != 3 {
+		t.Errorf("Replayed variants %v, want all 3", seen)
+	}
+
+	if _, err := rec.Client().Get(ts.URL + "/other"); err == nil {
+		t.Error("Expected error for unrecorded URL")
+	}
+}
+
+func TestFingerprintSelector(t *testing.T) {
+	entries := []recorder.Entry{
+		{
+			Request:  &recorder.Request{Method: "POST", URL: "http://foo.com/a?v=1", Headers: map[string]string{"X-Tenant": "one"}, Body: "x"},
+			Response: &recorder.Response{Body: "one"},
+		},
+		{
+			Request:  &recorder.Request{Method: "POST", URL: "http://foo.com/a?v=2", Headers: map[string]string{"X-Tenant": "two"}, Body: "x"},
+			Response: &recorder.Response{Body: "two"},
+		},
+	}
+
+	sel := recorder.FingerprintSelector(
+		func(r *http.Request) string {
+			b, _ := ioutil.ReadAll(r.Body)
+			return r.URL.Path + " " + r.Header.Get("X-Tenant") + " " + string(b)
+		},
+		func(r *recorder.Request) string {
+			u, _ := url.Parse(r.URL)
+			return u.Path + " " + r.Header("X-Tenant") + " " + r.Body
+		},
+	)
+
+	testcases := []struct {
+		Tenant, Body string
+		Expected     string
+	}{
+		{"one", "x", "one"},
+		{"two", "x", "two"},
+		{"two", "y", ""},
+		{"three", "x", ""},
+	}
+
+	for _, test := range testcases {
+		req := httptest.NewRequest("POST", "http://foo.com/a?v=3", strings.NewReader(test.Body))
+		req.Header.Set("X-Tenant", test.Tenant)
+		e, ok := sel.Select(entries, req)
+		if test.Expected == "" {
+			if ok {
+				t.Errorf("%s %s: Expected no matching entry, but got %v", test.Tenant, test.Body, e)
+			}
+			continue
+		}
+		if !ok {
+			t.Errorf("%s %s: Expected a matching entry, but didn't get one", test.Tenant, test.Body)
+		} else if e.Response.Body != test.Expected {
+			t.Errorf("%s %s: Expected body %q, but got %q", test.Tenant, test.Body, test.Expected, e.Response.Body)
+		}
+
+		// The body can still be read
+		if b, _ := ioutil.ReadAll(req.Body); string(b) != test.Body {
+			t.Errorf("%s %s: Body after select = %q, want %q", test.Tenant, test.Body, b, test.Body)
+		}
+	}
+}
+
+func TestAuthHandshake(t *testing.T) {
+	ntlm := func(msgType byte, payload string) string {
+		b := append([]byte("NTLMSSP\x00"), msgType, 0, 0, 0)
+		return "NTLM " + base64.StdEncoding.EncodeToString(append(b, payload...))
+	}
+	entry := func(auth string, status int, body string) recorder.Entry {
+		headers := map[string]string{}
+		if auth != "" {
+			headers["Authorization"] = auth
+		}
+		return recorder.Entry{
+			Request:  &recorder.Request{Method: "GET", URL: "http://foo.com/secure", Headers: headers},
+			Response: &recorder.Response{StatusCode: status, Body: body},
+		}
+	}
+	entries := []recorder.Entry{
+		entry("", 401, "negotiate"),
+		entry(ntlm(1, "negotiate"), 401, "challenge"),
+		entry(ntlm(3, "recorded response"), 200, "secret"),
+	}
+
+	sel := &recorder.AuthHandshake{}
+	testcases := []struct {
+		Auth     string
+		Expected string
+	}{
+		{"", "negotiate"},
+		{ntlm(1, "negotiate"), "challenge"},
+		{ntlm(3, "different response"), "secret"},
+		{"Basic dXNlcjpwYXNz", ""},
+	}
+	for _, test := range testcases {
+		req := httptest.NewRequest("GET", "http://foo.com/secure", nil)
+		if test.Auth != "" {
+			req.Header.Set("Authorization", test.Auth)
+		}
+		e, ok := sel.Select(entries, req)
+		if test.Expected == "" {
+			if ok {
+				t.Errorf("%q: Expected no matching entry, but got %v", test.Auth, e)
+			}
+		} else if !ok {
+			t.Errorf("%q: Expected a matching entry, but didn't get one", test.Auth)
+		} else if e.Response.Body != test.Expected {
+			t.Errorf("%q: Expected body %q, but got %q", test.Auth, test.Expected, e.Response.Body)
+		}
+	}
+}
+
+func TestDebugSelector(t *testing.T) {
+	entries := []recorder.Entry{
+		{Request: &recorder.Request{Method: "GET", URL: "http://foo.com/a"}, Response: &recorder.Response{Body: "1"}},
+		{Request: &recorder.Request{Method: "GET", URL: "http://foo.com/b"}, Response: &recorder.Response{Body: "2"}},
+		{Request: &recorder.Request{Method: "GET", URL: "http://foo.com/a"}, Response: &recorder.Response{Body: "3"}},
+	}
+
+	var logs []string
+	logf := func(format string, args ...interface{}) {
+		logs = append(logs, fmt.Sprintf(format, args...))
+	}
+
+	sel := recorder.DebugSelector(recorder.Latest{}, logf)
+	e, ok := sel.Select(entries, httptest.NewRequest("GET", "http://foo.com/a", nil))
+	if !ok || e.Response.Body != "3" {
+		t.Errorf("Select() = %v, %t, want latest entry", e, ok)
+	}
+	want := []string{
+		"recorder: select GET http://foo.com/a: 2 of 3 entries have the same method and url [0 2]",
+		"recorder: select GET http://foo.com/a: selected entry 2 (GET http://foo.com/a)",
+	}
+	if diff := cmp.Diff(logs, want); diff != "" {
+		t.Errorf("Logs do not match (-got, +want)\n%s", diff)
+	}
+
+	// Default selection
+	logs = nil
+	sel = recorder.DebugSelector(nil, logf)
+	if e, ok := sel.Select(entries, httptest.NewRequest("GET", "http://foo.com/a", nil)); !ok || e.Response.Body != "1" {
+		t.Errorf("Select() = %v, %t, want first entry", e, ok)
+	}
+	if _, ok := sel.Select(entries, httptest.NewRequest("GET", "http://foo.com/c", nil)); ok {
+		t.Error("Expected no matching entry")
+	}
+	if got, want := logs[len(logs)-1], "recorder: select GET http://foo.com/c: no entry selected"; got != want {
+		t.Errorf("Last log = %q, want %q", got, want)
+	}
+}
+
+func TestHeaderSelector(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "target %s", r.Header.Get("X-Target"))
+	}))
+	defer ts.Close()
+
+	rec := recorder.New("testdata/header-selector")
+	rec.Mode = recorder.Record
+	cli := &http.Client{Transport: rec}
+	for _, target := range []string{"a", "b"} {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+"/gateway", nil)
+		req.Header.Set("X-Target", target)
+		if _, err := cli.Do(req); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rec = recorder.New("testdata/header-selector")
+	rec.Mode = recorder.ReplayOnly
+	rec.Selector = recorder.HeaderSelector("x-target")
+	cli = &http.Client{Transport: rec}
+
+	for _, target := range []string{"b", "a"} {
+		// The URL is ignored
+		req, _ := http.NewRequest(http.MethodGet, "http://gateway.invalid/other", nil)
+		req.Header.Set("X-Target", target)
+		resp, err := cli.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "target " + target; string(body) != want {
+			t.Errorf("Body = %q, want %q", body, want)
+		}
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/gateway", nil)
+	req.Header.Set("X-Target", "c")
+	if _, err := cli.Do(req); err == nil {
+		t.Errorf("Expected error for unrecorded header value")
+	}
+}
+
+func TestHeaderSelector_Canonical(t *testing.T) {
+	rec := &recorder.Recorder{Mode: recorder.ReplayOnly}
+	rec.Add(recorder.Entry{
+		Request: &recorder.Request{
+			Method: "POST",
+			URL:    "https://example.com/upload",
+			Headers: map[string]string{
+				"content-type":  "application/json ",
+				"X-API-VERSION": "2",
+			},
+		},
+		Response: &recorder.Response{StatusCode: 200, Body: "json"},
+	})
+	rec.Selector = recorder.HeaderSelector("X-Api-Version", "CONTENT-TYPE")
+
+	tests := []struct {
+		name   string
+		header http.Header
+		match  bool
+	}{
+		{"canonical", http.Header{"Content-Type": {"application/json"}, "X-Api-Version": {"2"}}, true},
+		{"lower case", http.Header{"content-type": {"application/json"}, "x-api-version": {" 2"}}, true},
+		{"upper case", http.Header{"CONTENT-TYPE": {"\tapplication/json"}, "X-API-VERSION": {"2"}}, true},
+		{"different value", http.Header{"Content-Type": {"application/json"}, "X-Api-Version": {"3"}}, false},
+		{"missing header", http.Header{"Content-Type": {"application/json"}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest("POST", "https://example.com/upload", nil)
+			req.Header = tt.header
+			_, err := rec.RoundTrip(req)
+			if tt.match && err != nil {
+				t.Errorf("RoundTrip: %v", err)
+			}
+			if !tt.match && err == nil {
+				t.Error("Expected error for mismatched headers")
+			}
+		})
+	}
+}
+
+func TestLatest(t *testing.T) {
+	entries := []recorder.Entry{
+		{
+			Request:  &recorder.Request{Method: "GET", URL: "http://foo.com/bar"},
+			Response: &recorder.Response{Body: "old"},
+		},
+		{
+			Request:  &recorder.Request{Method: "GET", URL: "http://foo.com/bar"},
+			Response: &recorder.Response{Body: "new"},
+		},
+		{
+			Request:  &recorder.Request{Method: "GET", URL: "http://foo.com/baz"},
+			Response: &recorder.Response{Body: "baz"},
+		},
+	}
+
+	var sel recorder.Latest
+
+	for i := 0; i < 2; i++ {
+		e, ok := sel.Select(entries, httptest.NewRequest("GET", "http://foo.com/bar", nil))
+		if !ok {
+			t.Fatalf("Expected a matching entry, but didn't get one")
+		}
+		if e.Response.Body != "new" {
+			t.Errorf("Expected body %q, but got %q", "new", e.Response.Body)
+		}
+	}
+
+	if e, ok := sel.Select(entries, httptest.NewRequest("GET", "http://foo.com/qux", nil)); ok {
+		t.Errorf("Expected no matching entry, but got %v", e)
+	}
+}
+
+func TestLatestTimestamp(t *testing.T) {
+	at := func(hour int) time.Time {
+		return time.Date(2019, 5, 1, hour, 0, 0, 0, time.UTC)
+	}
+	entry := func(body string, ts time.Time) recorder.Entry {
+		return recorder.Entry{
+			Request:   &recorder.Request{Method: "GET", URL: "http://foo.com/bar"},
+			Response:  &recorder.Response{Body: body},
+			Timestamp: ts,
+		}
+	}
+
+	tests := []struct {
+		name    string
+		entries []recorder.Entry
+		want    string
+	}{
+		{"newest first", []recorder.Entry{entry("new", at(12)), entry("old", at(10)), entry("mid", at(11))}, "new"},
+		{"newest in middle", []recorder.Entry{entry("old", at(10)), entry("new", at(12)), entry("mid", at(11))}, "new"},
+		{"same timestamp", []recorder.Entry{entry("first", at(10)), entry("second", at(10))}, "second"},
+		{"no timestamps", []recorder.Entry{entry("first", time.Time{}), entry("second", time.Time{})}, "second"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, ok := recorder.Latest{}.Select(tt.entries, httptest.NewRequest("GET", "http://foo.com/bar", nil))
+			if !ok {
+				t.Fatal("Expected a matching entry, but didn't get one")
+			}
+			if e.Response.Body != tt.want {
+				t.Errorf("Expected body %q, but got %q", tt.want, e.Response.Body)
+			}
+		})
+	}
+}
+
+func TestIgnoreHost(t *testing.T) {
+	entries := []recorder.Entry{
+		{
+			Request:  &recorder.Request{Method: "GET", URL: "http://127.0.0.1:51234/users?page=1"},
+			Response: &recorder.Response{Body: "page 1"},
+		},
+		{
+			Request:  &recorder.Request{Method: "GET", URL: "http://127.0.0.1:51234/users?page=2"},
+			Response: &recorder.Response{Body: "page 2"},
+		},
+		{
+			Request:  &recorder.Request{Method: "DELETE", URL: "http://127.0.0.1:51234/users"},
+			Response: &recorder.Response{Body: "deleted"},
+		},
+	}
+
+	testcases := []struct {
+		Method, URL, ExpectedBody string
+	}{
+		{"GET", "https://api.example.com/users?page=2", "page 2"},
+		{"GET", "http://127.0.0.1:60000/users?page=1", "page 1"},
+		{"DELETE", "http://localhost/users", "deleted"},
+		{"GET", "https://api.example.com/users", ""}, // no matching query
+		{"GET", "https://api.example.com/other?page=1", ""},
+	}
+
+	var sel recorder.IgnoreHost
+
+	for _, test := range testcases {
+		e, ok := sel.Select(entries, httptest.NewRequest(test.Method, test.URL, nil))
+		if test.ExpectedBody == "" { // nolint: gocritic
+			if ok {
+				t.Errorf("%s %s: Expected no matching entry, but got %v", test.Method, test.URL, e)
+			}
+		} else if !ok {
+			t.Errorf("%s %s: Expected a matching entry, but didn't get one", test.Method, test.URL)
+		} else if e.Response.Body != test.ExpectedBody {
+			t.Errorf("%s %s: Entry mismatch. Expected body %q, but got %q",
+				test.Method, test.URL, test.ExpectedBody, e.Response.Body)
+		}
+	}
+}
+
+func TestBodyMatcher(t *testing.T) {
+	testcases := []struct {
+		Matcher            recorder.BodyMatcher
+		Recorded, Incoming string
+		Match              bool
+	}{
+		{recorder.ExactBody{}, `{"a":1}`, `{"a":1}`, true},
+		{recorder.ExactBody{}, `{"a":1}`, `{"a": 1}`, false},
+		{recorder.JSONBody{}, `{"a":1,"b":[1,2]}`, `{ "b": [1, 2], "a": 1 }`, true},
+		{recorder.JSONBody{}, `{"a":1,"b":[1,2]}`, `{"a":1,"b":[2,1]}`, false},
+		{recorder.JSONBody{}, `{"a":1}`, `{"a":1,"b":2}`, false},
+		{recorder.JSONBody{}, `not json`, `not json`, true},
+		{recorder.JSONBody{}, `not json`, `{}`, false},
+		{recorder.JSONBody{}, `{"n":1.0}`, `{"n":1}`, true},
+		{recorder.JSONBody{}, `{"n":1e3}`, `{"n":1000}`, true},
+		{recorder.JSONBody{}, `{"n":1.5E-1}`, `{"n":0.15}`, true},
+		{recorder.JSONBody{}, `{"n":-0}`, `{"n":0}`, true},
+		{recorder.JSONBody{}, `[1.0, 2e0]`, `[1,2]`, true},
+		{recorder.JSONBody{}, `{"n":9007199254740993}`, `{"n":9007199254740992}`, false},
+		{recorder.JSONBody{}, `{"n":1}`, `{"n":"1"}`, false},
+		{recorder.JSONBody{}, `{"b":true,"z":null}`, `{"z":null,"b":true}`, true},
+		{recorder.JSONBody{}, `{"b":true}`, `{"b":"true"}`, false},
+		{recorder.JSONBody{}, `{"z":null}`, `{}`, false},
+		{recorder.JSONBody{}, `{} {}`, `{}`, false},
+		{recorder.MatchJSONFields("user.id"), `{"user":{"id":10}}`, `{"user":{"id":1e1}}`, true},
+		{recorder.FormBody{}, `a=1&b=2&b=3`, `b=2&a=1&b=3`, true},
+		{recorder.FormBody{}, `a=1&b=2&b=3`, `a=1&b=2`, false},
+		{recorder.FormBody{}, `a=%zz`, `a=%zz`, true},
+		{recorder.MatchJSONFields("user.id", "action"), `{"user":{"id":1,"ts":100},"action":"buy","req":"a"}`, `{"action":"buy","user":{"id":1,"ts":200},"req":"b"}`, true},
+		{recorder.MatchJSONFields("user.id", "action"), `{"user":{"id":1},"action":"buy"}`, `{"user":{"id":2},"action":"buy"}`, false},
+		{recorder.MatchJSONFields("user.id"), `{"user":{"id":1}}`, `{"user":{}}`, false},
+		{recorder.MatchJSONFields("missing"), `{"a":1}`, `{"a":2}`, true},
+		{recorder.MatchJSONFields("items.1.sku"), `{"items":[{"sku":"a"},{"sku":"b","n":1}]}`, `{"items":[{"sku":"x"},{"sku":"b","n":2}]}`, true},
+		{recorder.MatchJSONFields("items.1.sku"), `{"items":[{"sku":"a"},{"sku":"b"}]}`, `{"items":[{"sku":"b"}]}`, false},
+		{recorder.MatchJSONFields("a"), `not json`, `{"a":1}`, false},
+	}
+
+	for _, test := range testcases {
+		got := test.Matcher.MatchBody([]byte(test.Recorded), []byte(test.Incoming))
+		if got != test.Match {
+			t.Errorf("%T.MatchBody(%q, %q) = %t, want %t", test.Matcher, test.Recorded, test.Incoming, got, test.Match)
+		}
+	}
+}
+
+func TestRoundTrip_BodyMatcher(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		fmt.Fprintf(w, "got %s", b)
+	}))
+	defer ts.Close()
+
+	rec := recorder.New("testdata/body-matcher")
+	rec.Mode = recorder.Record
+	cli := &http.Client{Transport: rec}
+	for _, body := range []string{`{"id":1}`, `{"id":2}`} {
+		if _, err := cli.Post(ts.URL, "application/json", strings.NewReader(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rec = recorder.New("testdata/body-matcher")
+	rec.Mode = recorder.ReplayOnly
+	rec.BodyMatcher = recorder.JSONBody{}
+	cli = &http.Client{Transport: rec}
+
+	resp, err := cli.Post(ts.URL, "application/json", strings.NewReader(`{ "id": 2 }`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `got {"id":2}`; string(body) != want {
+		t.Errorf("Body = %q, want %q", body, want)
+	}
+
+	if _, err := cli.Post(ts.URL, "application/json", strings.NewReader(`{"id":3}`)); err == nil {
+		t.Errorf("Expected error for unrecorded body")
+	}
+}
+
+func TestGraphQLSelector(t *testing.T) {
+	entry := func(body, resp string) recorder.Entry {
+		return recorder.Entry{
+			Request:  &recorder.Request{Method: "POST", URL: "https://example.com/graphql", Body: body},
+			Response: &recorder.Response{StatusCode: 200, Body: resp},
+		}
+	}
+	entries := []recorder.Entry{
+		entry(`{"operationName":"GetUser","query":"query GetUser($id: ID!) { user(id: $id) { name } }","variables":{"id":"1","full":true}}`, "user 1"),
+		entry(`{"operationName":"GetUser","query":"query GetUser($id: ID!) { user(id: $id) { name } }","variables":{"id":"2"}}`, "user 2"),
+		entry(`{"operationName":"ListUsers","query":"query ListUsers { users { name } }"}`, "users"),
+	}
+
+	tests := []struct {
+		name           string
+		matchVariables bool
+		body           string
+		want           string
+	}{
+		{"operation", false, `{"operationName":"ListUsers","query":"query ListUsers { users { id } }"}`, "users"},
+		{"first with operation", false, `{"operationName":"GetUser","variables":{"id":"2"}}`, "user 1"},
+		{"variables", true, `{"operationName":"GetUser","variables":{"id":"2"}}`, "user 2"},
+		{"variable order", true, `{"variables":{"full":true,"id":"1"},"operationName":"GetUser"}`, "user 1"},
+		{"different variables", true, `{"operationName":"GetUser","variables":{"id":"3"}}`, ""},
+		{"unknown operation", false, `{"operationName":"DeleteUser"}`, ""},
+		{"no operation name", false, `{"query":"{ users { name } }"}`, ""},
+		{"not json", false, `operationName=GetUser`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := &recorder.Recorder{Mode: recorder.ReplayOnly}
+			rec.Add(entries...)
+			rec.Selector = recorder.GraphQLSelector(tt.matchVariables)
+
+			req, _ := http.NewRequest("POST", "https://example.com/graphql", strings.NewReader(tt.body))
+			resp, err := rec.RoundTrip(req)
+			if tt.want == "" {
+				if err == nil {
+					t.Error("Expected error for unmatched request")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := ioutil.ReadAll(resp.Body)
+			if string(body) != tt.want {
+				t.Errorf("Body = %q, want %q", body, tt.want)
+			}
+		})
+	}
+}
+
+func TestBestMatch(t *testing.T) {
+	entry := func(accept, tenant, body, resp string) recorder.Entry {
+		return recorder.Entry{
+			Request: &recorder.Request{
+				Method:  "POST",
+				URL:     "https://example.com/items",
+				Headers: map[string]string{"Accept": accept, "X-Tenant": tenant},
+				Body:    body,
+			},
+			Response: &recorder.Response{StatusCode: 200, Body: resp},
+		}
+	}
+	entries := []recorder.Entry{
+		entry("application/json", "a", `{"id":1}`, "json a 1"),
+		entry("text/plain", "b", `{"id":1}`, "text b 1"),
+		entry("application/json", "b", `{"id":2}`, "json b 2"),
+		entry("application/json", "b", `{"id":2}`, "json b 2 again"),
+	}
+	sel := recorder.BestMatch{
+		Headers: []string{"Accept", "X-Tenant"},
+		Body:    recorder.JSONBody{},
+	}
+
+	tests := []struct {
+		accept, tenant, body string
+		want                 string
+	}{
+		{"application/json", "a", `{"id":1}`, "json a 1"},
+		{"text/plain", "b", `{"id": 1}`, "text b 1"},
+		{"application/json", "b", `{"id":2}`, "json b 2"},
+		{"application/json", "c", `{"id":2}`, "json b 2"},
+		{"text/plain", "b", `{"id":2}`, "text b 1"}, // tie
+		{"text/plain", "c", `{"id":3}`, "text b 1"},
+		{"application/xml", "c", `{"id":3}`, "json a 1"},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest("POST", "https://example.com/items", strings.NewReader(tt.body))
+		req.Header.Set("Accept", tt.accept)
+		req.Header.Set("X-Tenant", tt.tenant)
+		e, ok := sel.Select(entries, req)
+		if !ok {
+			t.Errorf("%s %s %s: no entry selected", tt.accept, tt.tenant, tt.body)
+			continue
+		}
+		if e.Response.Body != tt.want {
+			t.Errorf("%s %s %s: selected %q, want %q", tt.accept, tt.tenant, tt.body, e.Response.Body, tt.want)
+		}
+		// The body can still be read
+		if b, _ := ioutil.ReadAll(req.Body); string(b) != tt.body {
+			t.Errorf("Body after Select = %q, want %q", b, tt.body)
+		}
+	}
+
+	req, _ := http.NewRequest("POST", "https://example.com/other", nil)
+	if _, ok := sel.Select(entries, req); ok {
+		t.Error("Selected entry with different URL")
+	}
+	req, _ = http.NewRequest("POST", "https://example.com/items", nil)
+	req.Header.Set("X-Tenant", "b")
+	if got := sel.Score(entries[1], req, []byte(`{"id":1}`)); got != 2 {
+		t.Errorf("Score = %d, want 2", got)
+	}
+}
+
+func TestAcceptSelector(t *testing.T) {
+	entry := func(contentType string) recorder.Entry {
+		return recorder.Entry{
+			Request: &recorder.Request{Method: "GET", URL: "https://example.com/users/1"},
+			Response: &recorder.Response{
+				StatusCode: 200,
+				Headers:    map[string]string{"Content-Type": contentType},
+				Body:       contentType,
+			},
+		}
+	}
+	entries := []recorder.Entry{
+		entry("application/json; charset=utf-8"),
+		entry("application/xml"),
+		entry("text/html"),
+	}
+
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{"", "application/json; charset=utf-8"},
+		{"application/xml", "application/xml"},
+		{"application/xml;q=0.9, application/json", "application/json; charset=utf-8"},
+		{"application/json;q=0.5, application/xml;q=0.8", "application/xml"},
+		{"text/*", "text/html"},
+		{"text/*;q=0.5, */*;q=0.1", "text/html"},
+		{"*/*, application/json;q=0", "application/xml"},
+		{"image/png", ""},
+	}
+	for _, tt := range tests {
+		rec := recorder.NewReplayOnly(entries...)
+		rec.Selector = recorder.AcceptSelector{}
+		req, _ := http.NewRequest("GET", "https://example.com/users/1", nil)
+		req.Header.Set("Accept", tt.accept)
+		resp, err := rec.RoundTrip(req)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("Accept %q: expected error for unacceptable entries", tt.accept)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Accept %q: %v", tt.accept, err)
+			continue
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		if string(body) != tt.want {
+			t.Errorf("Accept %q: selected %q, want %q", tt.accept, body, tt.want)
+		}
+	}
+}
+
+func TestAllAndAny(t *testing.T) {
+	entry := func(tenant string, id int) recorder.Entry {
+		return recorder.Entry{
+			Request: &recorder.Request{
+				Method:  "POST",
+				URL:     "https://example.com/graphql",
+				Headers: map[string]string{"X-Tenant": tenant},
+				Body:    fmt.Sprintf(`{"operationName":"GetUser","variables":{"id":%d}}`, id),
+			},
+			Response: &recorder.Response{StatusCode: 200, Body: fmt.Sprintf("%s%d", tenant, id)},
+		}
+	}
+	entries := []recorder.Entry{entry("a", 1), entry("b", 1), entry("b", 2)}
+	header := recorder.HeaderSelector("X-Tenant")
+	graphQL := recorder.GraphQLSelector(true)
+
+	tests := []struct {
+		name     string
+		selector recorder.Selector
+		tenant   string
+		id       int
+		want     string
+	}{
+		// The selectors on their own select entries 1 and 0
+		{"all", recorder.All(header, graphQL), "b", 1, "b1"},
+		{"all second", recorder.All(header, graphQL), "b", 2, "b2"},
+		{"all unknown tenant", recorder.All(header, graphQL), "c", 1, ""},
+		{"all none", recorder.All(), "a", 1, ""},
+		{"any first", recorder.Any(header, graphQL), "b", 2, "b1"},
+		{"any fallback", recorder.Any(header, graphQL), "c", 2, "b2"},
+		{"any no match", recorder.Any(header, graphQL), "c", 3, ""},
+		{"nested", recorder.Any(recorder.All(header, graphQL), graphQL), "a", 2, "b2"},
+	}
+	for _, tt := range tests {
+		body := fmt.Sprintf(`{"operationName":"GetUser","variables":{"id":%d}}`, tt.id)
+		req, _ := http.NewRequest("POST", "https://example.com/graphql", strings.NewReader(body))
+		req.Header.Set("X-Tenant", tt.tenant)
+		e, ok := tt.selector.Select(entries, req)
+		if tt.want == "" {
+			if ok {
+				t.Errorf("%s: selected %q, want none", tt.name, e.Response.Body)
+			}
+			continue
+		}
+		if !ok {
+			t.Errorf("%s: no entry selected, want %q", tt.name, tt.want)
+			continue
+		}
+		if e.Response.Body != tt.want {
+			t.Errorf("%s: selected %q, want %q", tt.name, e.Response.Body, tt.want)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+//go:build !windows
+// +build !windows
+
+package recorder_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/akupila/recorder"
+)
+
+func TestRoundTrip_FileModeUmask(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}))
+	defer ts.Close()
+
+	defer syscall.Umask(syscall.Umask(077))
+	removeRecording(t, "testdata/umask")
+
+	rec := recorder.New("testdata/umask")
+	rec.Mode = recorder.Record
+	rec.PrettyJSON = true // Rewrites the whole file
+	if _, err := rec.Client().Get(ts.URL); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat("testdata/umask.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fi.Mode().Perm(); got != 0600 {
+		t.Errorf("File mode = %v, want %v", got, os.FileMode(0600))
+	}
+
+	// Existing files keep their permissions
+	if err := os.Chmod("testdata/umask.yml", 0640); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rec.Client().Get(ts.URL + "/other"); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err = os.Stat("testdata/umask.yml"); err != nil {
+		t.Fatal(err)
+	}
+	if got := fi.Mode().Perm(); got != 0640 {
+		t.Errorf("Rewritten file mode = %v, want %v", got, os.FileMode(0640))
+	}
+}
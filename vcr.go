@@ -0,0 +1,59 @@
+package recorder
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"gopkg.in/yaml.v2"
+)
+
+// vcrCassette is the format of cassettes recorded with go-vcr.
+type vcrCassette struct {
+	Interactions []struct {
+		Request struct {
+			Method  string              `yaml:"method"`
+			URL     string              `yaml:"url"`
+			Headers map[string][]string `yaml:"headers"`
+			Body    string              `yaml:"body"`
+		} `yaml:"request"`
+		Response struct {
+			Code    int                 `yaml:"code"`
+			Headers map[string][]string `yaml:"headers"`
+			Body    string              `yaml:"body"`
+		} `yaml:"response"`
+	} `yaml:"interactions"`
+}
+
+// ImportVCR reads a cassette recorded with go-vcr
+// (https://github.com/dnaeon/go-vcr) and returns its interactions as entries.
+//
+// Only the method, url, headers and body of requests and the status code,
+// headers and body of responses are imported. Headers are flattened to their
+// first value.
+func ImportVCR(filename string) ([]Entry, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var c vcrCassette
+	if err := yaml.Unmarshal(b, &c); err != nil {
+		return nil, fmt.Errorf("unmarshal %s: %v", filename, err)
+	}
+	entries := make([]Entry, 0, len(c.Interactions))
+	for _, in := range c.Interactions {
+		entries = append(entries, Entry{
+			Request: &Request{
+				Method:  in.Request.Method,
+				URL:     in.Request.URL,
+				Headers: flattenHeader(in.Request.Headers),
+				Body:    in.Request.Body,
+			},
+			Response: &Response{
+				StatusCode: in.Response.Code,
+				Headers:    flattenHeader(in.Response.Headers),
+				Body:       in.Response.Body,
+			},
+		})
+	}
+	return entries, nil
+}
@@ -0,0 +1,95 @@
+package recorder_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/akupila/recorder"
+	"github.com/google/go-cmp/cmp"
+)
+
+const vcrCassette = `---
+version: 1
+interactions:
+- request:
+    body: '{"name":"test"}'
+    form: {}
+    headers:
+      Content-Type:
+      - application/json
+    url: https://example.com/users
+    method: POST
+  response:
+    body: '{"id":1}'
+    headers:
+      Content-Type:
+      - application/json
+      Set-Cookie:
+      - a=1
+      - b=2
+    status: 201 Created
+    code: 201
+    duration: ""
+- request:
+    body: ""
+    form: {}
+    headers: {}
+    url: https://example.com/users/1
+    method: GET
+  response:
+    body: not found
+    headers: {}
+    status: 404 Not Found
+    code: 404
+    duration: ""
+`
+
+func TestImportVCR(t *testing.T) {
+	if err := os.MkdirAll("testdata", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile("testdata/vcr.yaml", []byte(vcrCassette), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := recorder.ImportVCR("testdata/vcr.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []recorder.Entry{
+		{
+			Request: &recorder.Request{
+				Method:  "POST",
+				URL:     "https://example.com/users",
+				Headers: map[string]string{"Content-Type": "application/json"},
+				Body:    `{"name":"test"}`,
+			},
+			Response: &recorder.Response{
+				StatusCode: 201,
+				Headers:    map[string]string{"Content-Type": "application/json", "Set-Cookie": "a=1"},
+				Body:       `{"id":1}`,
+			},
+		},
+		{
+			Request: &recorder.Request{
+				Method:  "GET",
+				URL:     "https://example.com/users/1",
+				Headers: map[string]string{},
+			},
+			Response: &recorder.Response{
+				StatusCode: 404,
+				Headers:    map[string]string{},
+				Body:       "not found",
+			},
+		},
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("Imported entries do not match (-got, +want)\n%s", diff)
+	}
+
+	if _, err := recorder.ImportVCR("testdata/vcr-missing.yaml"); err == nil {
+		t.Errorf("Expected error for missing file")
+	}
+}